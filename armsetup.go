@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// Guided set up of the ARM switch, for an FC with no (valid) ARM range.
+// New ranges are on otherwise unused AUX channels, at 1700-2100us, or as
+// an ARM range on a channel beyond those the FC has (which is moved).
+
+const (
+	setup_START = 32 // 1700us
+	setup_END   = 48 // 2100us
+)
+
+var stdin_reader *bufio.Reader
+
+func ask(prompt string, dflt bool) bool {
+	if stdin_reader == nil {
+		stdin_reader = bufio.NewReader(os.Stdin)
+	}
+	if dflt {
+		fmt.Fprintf(os.Stderr, "%s [Y/n] ", prompt)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	}
+	s, err := stdin_reader.ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return dflt
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// arm_unusable is true for an ARM range that can't be used as a switch,
+// i.e. one that is on at our "off" values (disarmed, disarming)
+func arm_unusable(r ModeRange) bool {
+	return r.active(arm_OFF) || r.active(arm_DISARM)
+}
+
+// arm_usable is true if there is an ARM switch to use, on a channel the
+// FC has
+func (m *MSPSerial) arm_usable() bool {
+	return m.armchan != -1 && int(m.armchan) < m.nchan && m.armval >= 1000
+}
+
+// fix_arm_range offers to program ARM (and optionally ANGLE) ranges,
+// returning true if the FC then has a usable ARM switch
+func (m *MSPSerial) fix_arm_range() bool {
+	v, err := m.Transact(msp.MODE_RANGES, nil, setting_TIMEOUT)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Mode ranges: %v\n", err)
+		return false
+	}
+	raw := v.data[:v.len]
+
+	// Slots to reuse (unusable ARM ranges, or those on channels the FC
+	// doesn't have, are cleared), and AUX channels in use
+	var free, stale []int
+	start, end := byte(setup_START), byte(setup_END)
+	moved := false
+	used := make(map[byte]bool)
+	for j := 0; j+3 < len(raw); j += 4 {
+		r := ModeRange{raw[j], raw[j+1], raw[j+2], raw[j+3]}
+		switch {
+		case r.end == 0:
+			free = append(free, j/4)
+		case r.boxid == PERM_ARM && arm_unusable(r):
+			fmt.Fprintf(os.Stderr, "Unusable ARM range: ")
+			m.dump_mode(r)
+			stale = append(stale, j/4)
+		case r.boxid == PERM_ARM && int(r.chanidx)+4 >= m.nchan:
+			fmt.Fprintf(os.Stderr, "ARM range beyond channel %d: ", m.nchan)
+			m.dump_mode(r)
+			stale = append(stale, j/4)
+			if !moved { // keep its values on the new channel
+				start, end, moved = r.start, r.end, true
+			}
+		default:
+			used[r.chanidx] = true
+		}
+	}
+	free = append(stale, free...)
+
+	var auxen []byte
+	for c := 0; c < m.nchan-4; c++ {
+		if !used[byte(c)] {
+			auxen = append(auxen, byte(c))
+		}
+	}
+	if len(auxen) == 0 || len(free) == 0 {
+		fmt.Fprintln(os.Stderr, "No free AUX channel / mode slot for ARM")
+		return false
+	}
+
+	fmt.Fprintln(os.Stderr, "No usable ARM switch is configured.")
+	if !ask(fmt.Sprintf("Program ARM on AUX%d (channel %d), %d-%dus?",
+		auxen[0]+1, auxen[0]+5, make_pwm(start), make_pwm(end)), false) {
+		return false
+	}
+	ranges := []ModeRange{{PERM_ARM, auxen[0], start, end}}
+	if m.angchan == -1 && len(auxen) > 1 && len(free) > 1 {
+		if ask(fmt.Sprintf("Also program ANGLE on AUX%d (channel %d)?", auxen[1]+1, auxen[1]+5), true) {
+			ranges = append(ranges, ModeRange{PERM_ANGLE, auxen[1], setup_START, setup_END})
+		}
+	}
+
+	for i, r := range ranges {
+		if err := m.set_mode_range(free[i], r); err != nil {
+			fmt.Fprintf(os.Stderr, "Set mode range: %v\n", err)
+			return false
+		}
+	}
+	for i := len(ranges); i < len(stale); i++ {
+		m.set_mode_range(free[i], ModeRange{}) // clear remaining unusable ARM ranges
+	}
+
+	if ask("Save to EEPROM?", true) {
+		if err := m.SaveEEPROM(); err != nil {
+			fmt.Fprintf(os.Stderr, "EEPROM write: %v\n", err)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Not saved, the ranges will be lost when the FC reboots")
+	}
+
+	// Confirm from the FC
+	v, err = m.Transact(msp.MODE_RANGES, nil, setting_TIMEOUT)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Mode ranges: %v\n", err)
+		return false
+	}
+	m.armchan, m.angchan = -1, -1
+	m.mranges = nil
+	m.deserialise_modes(v.data[:v.len])
+	m.set_info_ranges()
+	return m.arm_usable()
+}
+
+func (m *MSPSerial) set_mode_range(slot int, r ModeRange) error {
+	_, err := m.Transact(msp.SET_MODE_RANGE, []byte{byte(slot), r.boxid, r.chanidx, r.start, r.end}, setting_TIMEOUT)
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestFixArmRange(t *testing.T) {
+	tests := []struct {
+		profile    string
+		armchan    int8
+		armval     uint16
+		start, end byte
+	}{
+		{"noarm", 8, 1900, setup_START, setup_END},
+		{"badarm", 8, 1900, setup_START, setup_END},
+		{"fararm", 8, 1800, 24, 48}, // moved, keeping its values
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			m := mock_init(t, tt.profile)
+			if m.arm_usable() {
+				t.Fatal("the ARM switch is usable before the fix")
+			}
+			// program ARM, no ANGLE, don't save
+			stdin_reader = bufio.NewReader(strings.NewReader("y\nn\nn\n"))
+			defer func() { stdin_reader = nil }()
+			if !m.fix_arm_range() {
+				t.Fatal("fix_arm_range failed")
+			}
+			if m.armchan != tt.armchan || m.armval != tt.armval {
+				t.Errorf("arm channel %d / %dus, want %d / %dus", m.armchan, m.armval, tt.armchan, tt.armval)
+			}
+			n := 0
+			for _, r := range m.sd.(*MockFC).p.ranges {
+				if r.boxid == PERM_ARM && r.end != 0 {
+					n++
+					if r.start != tt.start || r.end != tt.end || int(r.chanidx)+4 != int(m.armchan) {
+						t.Errorf("ARM range %+v", r)
+					}
+				}
+			}
+			if n != 1 {
+				t.Errorf("%d ARM ranges", n)
+			}
+			if _, err := m.serialise_rx(PHASE_Arming, vRCset{}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+	"go.bug.st/serial"
+)
+
+// Tried in order, most likely first
+var auto_bauds = []int{115200, 57600, 38400, 19200, 9600, 230400, 250000, 460800, 500000, 921600}
+
+const autobaud_WAIT = 300 * time.Millisecond
+
+// open_serial opens a serial port; a baud rate of 0 means auto-detect,
+// in which case the detected rate is returned.
+func open_serial(name string, baud int) (SerDev, int, error) {
+	if baud != 0 {
+		p, err := serial.Open(name, &serial.Mode{BaudRate: baud})
+		if err != nil {
+			return nil, 0, err
+		}
+		return p, baud, nil
+	}
+
+	p, err := serial.Open(name, &serial.Mode{BaudRate: auto_bauds[0]})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, b := range auto_bauds {
+		if err := p.SetMode(&serial.Mode{BaudRate: b}); err != nil {
+			continue
+		}
+		if probe_baud(p) {
+			p.SetReadTimeout(serial.NoTimeout)
+			log.Printf("Detected %d baud on %s\n", b, name)
+			return p, b, nil
+		}
+	}
+	p.Close()
+	return nil, 0, fmt.Errorf("no MSP response from %s at any baud rate", name)
+}
+
+// probe_baud sends msp_API_VERSION and waits for a CRC-clean reply
+func probe_baud(p serial.Port) bool {
+	p.ResetInputBuffer()
+	p.SetReadTimeout(50 * time.Millisecond)
+	if _, err := p.Write(msp.Encode(msp.Frame{Version: msp.V1, Cmd: msp.API_VERSION})); err != nil {
+		return false
+	}
+	dec := msp.NewDecoder(p)
+	deadline := time.Now().Add(autobaud_WAIT)
+	for time.Now().Before(deadline) {
+		f, err := dec.Decode()
+		if err == nil {
+			if f.Cmd == msp.API_VERSION && !f.IsError() && len(f.Payload) > 2 {
+				return true
+			}
+		} else {
+			var cerr *msp.CRCError
+			if !errors.As(err, &cerr) && err != io.EOF {
+				return false
+			}
+		}
+	}
+	return false
+}
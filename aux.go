@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AUX channel control. Each AUX channel rests at its default (1000us
+// unless an airframe template says otherwise), may be driven by the mode
+// selection, and may be set explicitly (from the keyboard or the API),
+// which takes precedence until cleared. The arm channel is never
+// available, it belongs to the arming logic. Channels are numbered as the
+// configurator, from 1 (so AUX1 is channel 5).
+
+const (
+	aux_MIN     = 900
+	aux_MAX     = 2100
+	aux_DEFAULT = 1000
+)
+
+// aux_index validates a channel number and returns its AUX index
+func (m *MSPSerial) aux_index(ch int) (byte, error) {
+	if ch < 5 || ch > m.nchan {
+		return 0, fmt.Errorf("channel %d: not an AUX channel (5-%d)", ch, m.nchan)
+	}
+	if int8(ch-1) == m.armchan {
+		return 0, fmt.Errorf("channel %d is the arm channel", ch)
+	}
+	return byte(ch - 5), nil
+}
+
+func check_aux_value(ch int, val int) error {
+	if val < aux_MIN || val > aux_MAX {
+		return fmt.Errorf("channel %d: %dus out of range %d-%d", ch, val, aux_MIN, aux_MAX)
+	}
+	return nil
+}
+
+// SetAux sets an AUX channel to val (us)
+func (m *MSPSerial) SetAux(ch int, val int) error {
+	idx, err := m.aux_index(ch)
+	if err != nil {
+		return err
+	}
+	if err := check_aux_value(ch, val); err != nil {
+		return err
+	}
+	m.amu.Lock()
+	defer m.amu.Unlock()
+	if m.auxset == nil {
+		m.auxset = make(map[byte]uint16)
+	}
+	m.auxset[idx] = uint16(val)
+	return nil
+}
+
+// StepAux changes an AUX channel by delta (us), clamped to the valid
+// range, returning the new value
+func (m *MSPSerial) StepAux(ch int, delta int) (int, error) {
+	idx, err := m.aux_index(ch)
+	if err != nil {
+		return 0, err
+	}
+	val := int(m.aux_value(idx)) + delta
+	if val < aux_MIN {
+		val = aux_MIN
+	} else if val > aux_MAX {
+		val = aux_MAX
+	}
+	return val, m.SetAux(ch, val)
+}
+
+// ClearAux returns an AUX channel to its default / mode value
+func (m *MSPSerial) ClearAux(ch int) error {
+	idx, err := m.aux_index(ch)
+	if err != nil {
+		return err
+	}
+	m.amu.Lock()
+	delete(m.auxset, idx)
+	m.amu.Unlock()
+	return nil
+}
+
+// Aux returns the value being sent for an AUX channel
+func (m *MSPSerial) Aux(ch int) (int, error) {
+	idx, err := m.aux_index(ch)
+	if err != nil {
+		return 0, err
+	}
+	return int(m.aux_value(idx)), nil
+}
+
+// next_aux returns the AUX channel after (dir > 0) or before ch,
+// wrapping and skipping the arm channel
+func (m *MSPSerial) next_aux(ch int, dir int) int {
+	n := m.nchan - 4
+	for i := 0; i < n; i++ {
+		ch = 5 + (ch-5+dir+n)%n
+		if int8(ch-1) != m.armchan {
+			break
+		}
+	}
+	return ch
+}
+
+// aux_key handles the AUX keys for the selected channel
+func (m *MSPSerial) aux_key(ev rune, ch int) {
+	var val int
+	var err error
+	switch ev {
+	case ',':
+		val, err = m.StepAux(ch, -25)
+	case '.':
+		val, err = m.StepAux(ch, 25)
+	case '<':
+		val, err = m.StepAux(ch, -100)
+	case '>':
+		val, err = m.StepAux(ch, 100)
+	case '{':
+		val, err = 1000, m.SetAux(ch, 1000)
+	case '}':
+		val, err = 2000, m.SetAux(ch, 2000)
+	case 'x', 'X':
+		if err = m.ClearAux(ch); err == nil {
+			val, err = m.Aux(ch)
+		}
+	}
+	if err != nil {
+		log.Printf("AUX: %v\n", err)
+	} else {
+		log.Printf("AUX channel %d: %dus\n", ch, val)
+	}
+}
+
+// SetAuxDefaults sets the resting values (channel number => us)
+func (m *MSPSerial) SetAuxDefaults(defs map[int]int) error {
+	auxdef := make(map[byte]uint16)
+	for ch, val := range defs {
+		idx, err := m.aux_index(ch)
+		if err != nil {
+			return err
+		}
+		if err := check_aux_value(ch, val); err != nil {
+			return err
+		}
+		auxdef[idx] = uint16(val)
+	}
+	m.amu.Lock()
+	m.auxdef = auxdef
+	m.amu.Unlock()
+	return nil
+}
+
+// aux_value is the value for an AUX index: explicit, else mode, else default
+func (m *MSPSerial) aux_value(idx byte) uint16 {
+	m.amu.Lock()
+	defer m.amu.Unlock()
+	if v, ok := m.auxset[idx]; ok {
+		return v
+	}
+	if v, ok := m.auxvals[idx]; ok {
+		return v
+	}
+	if v, ok := m.auxdef[idx]; ok {
+		return v
+	}
+	return aux_DEFAULT
+}
+
+// aux_rest is the value for an AUX index when the mode selection
+// doesn't drive it: explicit, else default
+func (m *MSPSerial) aux_rest(idx byte) uint16 {
+	m.amu.Lock()
+	defer m.amu.Unlock()
+	if v, ok := m.auxset[idx]; ok {
+		return v
+	}
+	if v, ok := m.auxdef[idx]; ok {
+		return v
+	}
+	return aux_DEFAULT
+}
+
+// clear_aux_overrides drops explicit values for channels now driven by
+// the mode selection
+func (m *MSPSerial) clear_aux_overrides(vals map[byte]uint16) {
+	m.amu.Lock()
+	defer m.amu.Unlock()
+	for idx := range vals {
+		delete(m.auxset, idx)
+	}
+}
+
+// aux_defaults sets the resting AUX values from the template file (if
+// any) for this craft, then the -aux settings
+func (m *MSPSerial) aux_defaults(tmpl string, spec string) error {
+	defs := make(map[int]int)
+	if tmpl != "" {
+		var err error
+		if defs, err = load_aux_template(tmpl, m.Info.Name); err != nil {
+			return err
+		}
+	}
+	if err := parse_aux(spec, defs); err != nil {
+		return err
+	}
+	if len(defs) > 0 {
+		log.Printf("AUX defaults: %s\n", format_aux(defs))
+	}
+	return m.SetAuxDefaults(defs)
+}
+
+func format_aux(defs map[int]int) string {
+	var chans []int
+	for ch := range defs {
+		chans = append(chans, ch)
+	}
+	sort.Ints(chans)
+	var sb []string
+	for _, ch := range chans {
+		sb = append(sb, fmt.Sprintf("%d=%d", ch, defs[ch]))
+	}
+	return strings.Join(sb, ",")
+}
+
+// parse_aux parses "ch=us" settings, separated by commas and / or spaces
+func parse_aux(spec string, defs map[int]int) error {
+	for _, f := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("AUX setting \"%s\": expected channel=us", f)
+		}
+		ch, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("AUX setting \"%s\": bad channel", f)
+		}
+		val, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("AUX setting \"%s\": bad value", f)
+		}
+		defs[ch] = val
+	}
+	return nil
+}
+
+// load_aux_template reads the AUX defaults for a craft from a template
+// file. Each line is a craft name (as MSP_NAME, "*" for any craft) then
+// channel=us settings; "*" lines apply first, so a named craft may
+// override them. Quote names containing spaces; '#' starts a comment.
+func load_aux_template(fn string, craft string) (map[int]int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var generic, named []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var name, rest string
+		if line[0] == '"' {
+			i := strings.IndexByte(line[1:], '"')
+			if i < 0 {
+				return nil, fmt.Errorf("%s:%d: unterminated name", fn, n)
+			}
+			name, rest = line[1:i+1], line[i+2:]
+		} else {
+			parts := strings.SplitN(line, " ", 2)
+			name = parts[0]
+			if len(parts) == 2 {
+				rest = parts[1]
+			}
+		}
+		switch name {
+		case "*":
+			generic = append(generic, rest)
+		case craft:
+			named = append(named, rest)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	defs := make(map[int]int)
+	for _, spec := range append(generic, named...) {
+		if err := parse_aux(spec, defs); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return defs, nil
+}
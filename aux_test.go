@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAux(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[int]int
+		err  string
+	}{
+		{"", map[int]int{}, ""},
+		{"9=2000", map[int]int{9: 2000}, ""},
+		{"9=2000,12=1500", map[int]int{9: 2000, 12: 1500}, ""},
+		{" 9=2000  12=1500,\t6=1000 ", map[int]int{9: 2000, 12: 1500, 6: 1000}, ""},
+		{"9=2000,9=1200", map[int]int{9: 1200}, ""},
+		{"9", nil, "expected channel=us"},
+		{"x=2000", nil, "bad channel"},
+		{"9=high", nil, "bad value"},
+	}
+	for _, tt := range tests {
+		defs := make(map[int]int)
+		err := parse_aux(tt.spec, defs)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("\"%s\": got %v, want an error with \"%s\"", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(defs, tt.want) {
+			t.Errorf("\"%s\": got %v %v, want %v", tt.spec, defs, err, tt.want)
+		}
+	}
+}
+
+const aux_template = `# AUX defaults
+*              6=1000 12=1500
+BENCHYMCTESTY  9=2000,12=1800   # overrides the "*" line for 12
+"Big Wing"     7=1700
+"Big Wing" 8=1100
+OTHER          9=1000
+`
+
+func write_template(t *testing.T, text string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "aux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "aux.txt")
+	if err := ioutil.WriteFile(fn, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestLoadAuxTemplate(t *testing.T) {
+	fn := write_template(t, aux_template)
+	tests := []struct {
+		craft string
+		want  map[int]int
+	}{
+		{"BENCHYMCTESTY", map[int]int{6: 1000, 9: 2000, 12: 1800}},
+		{"Big Wing", map[int]int{6: 1000, 7: 1700, 8: 1100, 12: 1500}},
+		{"unknown", map[int]int{6: 1000, 12: 1500}},
+		{"", map[int]int{6: 1000, 12: 1500}},
+	}
+	for _, tt := range tests {
+		defs, err := load_aux_template(fn, tt.craft)
+		if err != nil || !reflect.DeepEqual(defs, tt.want) {
+			t.Errorf("\"%s\": got %v %v, want %v", tt.craft, defs, err, tt.want)
+		}
+	}
+
+	for _, bad := range []struct{ text, err string }{
+		{"\"Big Wing 7=1700\n", "aux.txt:1: unterminated name"},
+		{"# ok\n* 6=1000\n* 6\n", "expected channel=us"},
+	} {
+		if _, err := load_aux_template(write_template(t, bad.text), "x"); err == nil || !strings.Contains(err.Error(), bad.err) {
+			t.Errorf("%q: got %v, want an error with \"%s\"", bad.text, err, bad.err)
+		}
+	}
+	if _, err := load_aux_template(filepath.Join(filepath.Dir(fn), "missing"), "x"); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestAuxDefaults(t *testing.T) {
+	fn := write_template(t, aux_template)
+	m := &MSPSerial{armchan: 9, nchan: 18}
+	m.Info.Name = "BENCHYMCTESTY"
+
+	// -aux overrides the template
+	if err := m.aux_defaults(fn, "12=1200"); err != nil {
+		t.Fatal(err)
+	}
+	for ch, want := range map[int]int{5: aux_DEFAULT, 6: 1000, 9: 2000, 12: 1200} {
+		if v, err := m.Aux(ch); err != nil || v != want {
+			t.Errorf("channel %d: %d %v, want %d", ch, v, err, want)
+		}
+	}
+
+	for _, spec := range []string{"10=2000", "4=1500", "19=1500", "9=2200"} {
+		if err := m.aux_defaults("", spec); err == nil {
+			t.Errorf("\"%s\": no error", spec)
+		}
+	}
+}
+
+func TestModesKeepAux(t *testing.T) {
+	m := solver_fc()
+	// BEEPER on, LAUNCH channel high (off)
+	if err := m.SetAuxDefaults(map[int]int{8: 2000, 12: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	// POSHOLD on
+	if err := m.SetAux(5, 1500); err != nil {
+		t.Fatal(err)
+	}
+
+	// The explicit value already gives POSHOLD, nothing is driven
+	if err := m.set_modes([]byte{PERM_POSHOLD}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.auxvals) != 0 {
+		t.Errorf("POSHOLD: driven %v", m.auxvals)
+	}
+
+	// MANUAL drives its channel and turns POSHOLD off, the other
+	// channels keep their defaults
+	if err := m.set_modes([]byte{PERM_MANUAL}); err != nil {
+		t.Fatal(err)
+	}
+	for ch, want := range map[int]int{5: 1100, 8: 2000, 11: 1775, 12: 2000} {
+		if v, err := m.Aux(ch); err != nil || v != want {
+			t.Errorf("MANUAL: channel %d %d %v, want %d", ch, v, err, want)
+		}
+	}
+}
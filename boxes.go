@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BoxMap relates the FC's boxes (modes) by box index (the bit in the
+// status box flags), permanent id (as used in mode ranges) and name,
+// from MSP_BOXNAMES and MSP_BOXIDS. The zero value is an empty map.
+type BoxMap struct {
+	names []string
+	ids   []byte
+	index map[byte]int // permanent id => box index
+}
+
+// NewBoxMap builds the map from the MSP_BOXNAMES (';' separated) and
+// MSP_BOXIDS payloads; ids may be nil for an FC without MSP_BOXIDS
+func NewBoxMap(names string, ids []byte) BoxMap {
+	var b BoxMap
+	for _, n := range strings.Split(names, ";") {
+		if n != "" {
+			b.names = append(b.names, n)
+		}
+	}
+	if len(ids) == len(b.names) {
+		b.ids = ids
+		b.index = make(map[byte]int)
+		for i, id := range ids {
+			b.index[id] = i
+		}
+	}
+	return b
+}
+
+func (b *BoxMap) HasIDs() bool {
+	return b.index != nil
+}
+
+// Name returns the name of a permanent id, "BOXnn" if the FC doesn't
+// have it
+func (b *BoxMap) Name(id byte) string {
+	if i, ok := b.index[id]; ok {
+		return b.names[i]
+	}
+	return fmt.Sprintf("BOX%d", id)
+}
+
+// Mask returns the box flag for a permanent id, 0 if the FC doesn't
+// have it
+func (b *BoxMap) Mask(id byte) uint64 {
+	if i, ok := b.index[id]; ok {
+		return 1 << i
+	}
+	return 0
+}
+
+// ByName returns the box index for a name
+func (b *BoxMap) ByName(name string) (int, bool) {
+	for i, n := range b.names {
+		if n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (b *BoxMap) Names() []string {
+	return b.names
+}
+
+// Format lists the names of the boxes set in bval
+func (b *BoxMap) Format(bval uint64) string {
+	var sb []string
+	for i, n := range b.names {
+		if bval&(1<<i) != 0 {
+			sb = append(sb, n)
+		}
+	}
+	return strings.Join(sb, ",")
+}
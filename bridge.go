@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// Bridge mode: external MSP clients (configurator, mwp etc.) share the FC
+// link. Client requests are forwarded to the FC; as the FC answers in
+// order, each reply is routed to the oldest outstanding request for that
+// command, whether ours or a client's. Requests before it are then known
+// to be unanswered (a request or reply was lost) and are dropped, as are
+// requests older than route_TTL, so a lost reply cannot misroute later
+// ones.
+
+const route_TTL = 2 * time.Second
+
+type bridge_client struct {
+	conn net.Conn
+	wmu  sync.Mutex
+}
+
+type msp_route struct {
+	cmd    uint16
+	vers   msp.Version
+	client *bridge_client // nil for our own requests
+	t      time.Time
+}
+
+func (c *bridge_client) reply(vers msp.Version, sc SChan) {
+	dirn := byte(msp.FromFC)
+	if !sc.ok {
+		dirn = msp.Error
+	}
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second)) // don't let a stalled client block the FC
+	c.conn.Write(msp.Encode(msp.Frame{Version: vers, Dirn: dirn, Cmd: sc.cmd, Payload: sc.data}))
+	c.wmu.Unlock()
+}
+
+// StartBridge serves MSP clients on addr (e.g. ":5770")
+func (m *MSPSerial) StartBridge(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.bridged = true
+	m.mu.Unlock()
+	log.Printf("MSP bridge on %s\n", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("Bridge: %v\n", err)
+				return
+			}
+			go m.serve_client(&bridge_client{conn: conn})
+		}
+	}()
+	return nil
+}
+
+func (m *MSPSerial) serve_client(c *bridge_client) {
+	log.Printf("Bridge: client %s connected\n", c.conn.RemoteAddr())
+	dec := msp.NewDecoder(c.conn)
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			var cerr *msp.CRCError
+			if errors.As(err, &cerr) {
+				continue
+			}
+			if err != io.EOF {
+				log.Printf("Bridge: client %s: %v\n", c.conn.RemoteAddr(), err)
+			}
+			break
+		}
+		if f.Dirn == msp.ToFC {
+			m.forward(c, f)
+		}
+	}
+	c.conn.Close()
+	log.Printf("Bridge: client %s disconnected\n", c.conn.RemoteAddr())
+}
+
+// forward sends a client's request to the FC, in the client's framing
+func (m *MSPSerial) forward(c *bridge_client, f msp.Frame) {
+	m.wmu.Lock()
+	m.add_route(f.Cmd, f.Version, c)
+	m.enc.Encode(msp.Frame{Version: f.Version, Flags: f.Flags, Cmd: f.Cmd, Payload: f.Payload})
+	m.wmu.Unlock()
+}
+
+// add_route records an outstanding request
+func (m *MSPSerial) add_route(cmd uint16, vers msp.Version, c *bridge_client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.bridged {
+		return
+	}
+	now := time.Now()
+	m.prune_routes(now)
+	m.routes = append(m.routes, msp_route{cmd: cmd, vers: vers, client: c, t: now})
+}
+
+// prune_routes drops expired routes, wherever they are; the caller holds
+// m.mu
+func (m *MSPSerial) prune_routes(now time.Time) {
+	live := m.routes[:0]
+	for _, r := range m.routes {
+		if now.Sub(r.t) <= route_TTL {
+			live = append(live, r)
+		}
+	}
+	m.routes = live
+}
+
+// take_route removes and returns the oldest live route for cmd, dropping
+// the (unanswered) routes before it; the caller holds m.mu
+func (m *MSPSerial) take_route(cmd uint16) (msp_route, bool) {
+	m.prune_routes(time.Now())
+	for i, r := range m.routes {
+		if r.cmd == cmd {
+			m.routes = append(m.routes[:0], m.routes[i+1:]...)
+			return r, true
+		}
+	}
+	return msp_route{}, false
+}
@@ -4,7 +4,6 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"log"
 	"golang.org/x/sys/unix"
 )
 
@@ -22,22 +21,21 @@ func str2ba(addr string) [6]byte {
 	return b
 }
 
-func check(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func NewBT(id string) *BTConn {
+func NewBT(id string) (*BTConn, error) {
 	mac := str2ba(id)
 	bt := &BTConn{fd: -1}
 	fd, err := unix.Socket(syscall.AF_BLUETOOTH, syscall.SOCK_STREAM, unix.BTPROTO_RFCOMM)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
 	bt.fd = fd
 	addr := &unix.SockaddrRFCOMM{Addr: mac, Channel: 1}
 	err = unix.Connect(bt.fd, addr)
-	check(err)
-	return bt
+	if err != nil {
+		unix.Close(bt.fd)
+		return nil, err
+	}
+	return bt, nil
 }
 
 func (bt *BTConn) Read(buf []byte) (int, error) {
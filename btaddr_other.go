@@ -3,7 +3,6 @@
 package main
 
 import (
-	"log"
 	"errors"
 )
 
@@ -11,9 +10,8 @@ type BTConn struct {
 	fd int
 }
 
-func NewBT(id string) *BTConn {
-	log.Fatal("BT sockets are Linux only")
-	return &BTConn{-1}
+func NewBT(id string) (*BTConn, error) {
+	return nil, errors.New("BT sockets are Linux only")
 }
 
 func (bt *BTConn) Read(buf []byte) (int, error) {
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture file format: the magic string, then records of
+//   offset (int64 ns since start) | dirn ('R' read, 'W' written) | len (uint32) | data
+// all little endian.
+
+const capture_MAGIC = "MSPCAP1\n"
+
+const (
+	cap_READ  = 'R'
+	cap_WRITE = 'W'
+)
+
+type capwriter struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+func NewCapture(fn string) (*capwriter, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(capture_MAGIC); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &capwriter{f: f, start: time.Now()}, nil
+}
+
+func (c *capwriter) record(dirn byte, buf []byte) {
+	hdr := make([]byte, 13)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(time.Since(c.start)))
+	hdr[8] = dirn
+	binary.LittleEndian.PutUint32(hdr[9:13], uint32(len(buf)))
+	c.f.Write(hdr)
+	c.f.Write(buf)
+}
+
+// CaptureDev is a SerDev that records all traffic through it
+type CaptureDev struct {
+	sd SerDev
+	cw *capwriter
+}
+
+func (c *CaptureDev) Read(buf []byte) (int, error) {
+	n, err := c.sd.Read(buf)
+	if n > 0 {
+		c.cw.record(cap_READ, buf[:n])
+	}
+	return n, err
+}
+
+func (c *CaptureDev) Write(buf []byte) (int, error) {
+	c.cw.record(cap_WRITE, buf)
+	return c.sd.Write(buf)
+}
+
+func (c *CaptureDev) Close() error {
+	return c.sd.Close()
+}
+
+type caprecord struct {
+	offset time.Duration
+	dirn   byte
+	data   []byte
+}
+
+func read_capture(fn string) ([]caprecord, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(capture_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != capture_MAGIC {
+		return nil, fmt.Errorf("%s: not a capture file", fn)
+	}
+	var recs []caprecord
+	hdr := make([]byte, 13)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%s: truncated", fn)
+		}
+		rec := caprecord{offset: time.Duration(binary.LittleEndian.Uint64(hdr[0:8])), dirn: hdr[8]}
+		rec.data = make([]byte, binary.LittleEndian.Uint32(hdr[9:13]))
+		if _, err := io.ReadFull(r, rec.data); err != nil {
+			return nil, fmt.Errorf("%s: truncated", fn)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// A reply is held until as many writes as preceded it in the capture
+// have been made (so it isn't seen before its request), for up to this
+// long after its original time
+const replay_WAIT = time.Second
+
+// ReplayDev is a SerDev that plays back the FC side of a capture with
+// the original timing; writes are discarded, but counted
+type ReplayDev struct {
+	recs   []caprecord
+	idx    int
+	need   int // writes before recs[idx] in the capture
+	start  time.Time
+	pend   []byte
+	mu     sync.Mutex
+	writes int
+	wrote  chan struct{}
+	closed chan struct{}
+}
+
+func NewReplay(fn string) (*ReplayDev, error) {
+	recs, err := read_capture(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayDev{recs: recs, start: time.Now(), wrote: make(chan struct{}, 1),
+		closed: make(chan struct{})}, nil
+}
+
+func (r *ReplayDev) Read(buf []byte) (int, error) {
+	for len(r.pend) == 0 {
+		for r.idx < len(r.recs) && r.recs[r.idx].dirn != cap_READ {
+			if r.recs[r.idx].dirn == cap_WRITE {
+				r.need++
+			}
+			r.idx++
+		}
+		if r.idx == len(r.recs) {
+			return 0, io.EOF
+		}
+		rec := r.recs[r.idx]
+		r.idx++
+		due := r.start.Add(rec.offset)
+		giveup := time.After(time.Until(due.Add(replay_WAIT)))
+		for waiting := true; waiting && !r.written(r.need); {
+			select {
+			case <-r.wrote:
+			case <-giveup:
+				waiting = false
+			case <-r.closed:
+				return 0, errors.New("replay closed")
+			}
+		}
+		select {
+		case <-time.After(time.Until(due)):
+		case <-r.closed:
+			return 0, errors.New("replay closed")
+		}
+		r.pend = rec.data
+	}
+	n := copy(buf, r.pend)
+	r.pend = r.pend[n:]
+	return n, nil
+}
+
+func (r *ReplayDev) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	r.writes++
+	r.mu.Unlock()
+	select {
+	case r.wrote <- struct{}{}:
+	default:
+	}
+	return len(buf), nil
+}
+
+func (r *ReplayDev) written(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writes >= n
+}
+
+func (r *ReplayDev) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return nil
+}
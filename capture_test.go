@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "mock.cap")
+
+	// Capture an init against the mock, then replay it
+	dd := parse_device("mock://nogps")
+	dd.capture = fn
+	m := MSPInit(dd)
+	m.sd.Close()
+	m.capture.f.Close()
+
+	recs, err := read_capture(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nr, nw int
+	for i, r := range recs {
+		switch r.dirn {
+		case cap_READ:
+			nr++
+		case cap_WRITE:
+			nw++
+		default:
+			t.Fatalf("record %d: direction %c", i, r.dirn)
+		}
+		if i > 0 && r.offset < recs[i-1].offset {
+			t.Fatalf("record %d: offset %v before %v", i, r.offset, recs[i-1].offset)
+		}
+	}
+	if nr == 0 || nw == 0 {
+		t.Fatalf("%d reads, %d writes", nr, nw)
+	}
+
+	r := MSPInit(parse_device("replay://" + fn))
+	defer r.sd.Close()
+	var want, got bytes.Buffer
+	m.Info.WriteJSON(&want)
+	r.Info.WriteJSON(&got)
+	if got.String() != want.String() {
+		t.Errorf("replayed:\n%s\ncaptured:\n%s", got.String(), want.String())
+	}
+	if r.armchan != m.armchan || r.nchan != m.nchan || r.bypass != m.bypass || r.caps != m.caps {
+		t.Errorf("replayed arm %d, %d channels, bypass %v, caps %x; captured %d, %d, %v, %x",
+			r.armchan, r.nchan, r.bypass, r.caps, m.armchan, m.nchan, m.bypass, m.caps)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{
+		"empty":     "",
+		"magic":     "MSPCAP0\n",
+		"truncated": capture_MAGIC + "\x00\x00\x00",
+		"short":     capture_MAGIC + "\x00\x00\x00\x00\x00\x00\x00\x00R\x05\x00\x00\x00$M",
+	} {
+		fn := filepath.Join(dir, name)
+		ioutil.WriteFile(fn, []byte(data), 0644)
+		if _, err := read_capture(fn); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// One-shot commands, run after MSPInit instead of the control loop
+
+func (m *MSPSerial) run_command(args []string) error {
+	switch args[0] {
+	case "get", "set", "list":
+		if !m.caps.Has(CAP_SETTING_INFO) {
+			return errors.New("FC does not support MSP2_COMMON_SETTING_INFO")
+		}
+	}
+	switch args[0] {
+	case "info":
+		if *jsonout {
+			return m.Info.WriteJSON(os.Stdout)
+		}
+		m.Info.WriteText(os.Stdout)
+		return nil
+	case "get":
+		if len(args) < 2 {
+			return errors.New("usage: get name [name ...]")
+		}
+		var list []*Setting
+		for _, name := range args[1:] {
+			st, err := m.GetSetting(name)
+			if err != nil {
+				return err
+			}
+			list = append(list, st)
+		}
+		return print_settings(list)
+	case "set":
+		if len(args) < 2 {
+			return errors.New("usage: set name=value [name=value ...]")
+		}
+		var list []*Setting
+		for _, a := range args[1:] {
+			parts := strings.SplitN(a, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("set: expected name=value, got \"%s\"", a)
+			}
+			st, err := m.SetSetting(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			if err != nil {
+				return err
+			}
+			list = append(list, st)
+		}
+		if *save {
+			if err := m.SaveEEPROM(); err != nil {
+				return fmt.Errorf("EEPROM write: %v", err)
+			}
+			log.Println("Saved to EEPROM")
+		}
+		return print_settings(list)
+	case "list":
+		all, err := m.ListSettings()
+		if err != nil {
+			return err
+		}
+		var list []*Setting
+		for _, st := range all {
+			if len(args) < 2 || strings.Contains(st.Name, args[1]) {
+				list = append(list, st)
+			}
+		}
+		return print_settings(list)
+	default:
+		return fmt.Errorf("unknown command \"%s\"", args[0])
+	}
+}
+
+func print_settings(list []*Setting) error {
+	if *jsonout {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	for _, st := range list {
+		fmt.Println(st)
+	}
+	return nil
+}
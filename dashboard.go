@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-tty"
+)
+
+// Full screen terminal dashboard, drawn with ANSI sequences on the tty
+// (alternate screen, so the shell's screen is restored on exit). The log
+// is captured into a scrolling pane and replayed to stderr on exit. The
+// size is polled on each redraw, so resizing needs no signal (Windows).
+
+const (
+	dash_FRAME   = 100 * time.Millisecond // minimum redraw interval
+	dash_LOGSIZE = 500                    // log lines kept
+	dash_MINLOG  = 4                      // log pane rows, at least
+	dash_TOP     = 7                      // rows above the channels
+	dash_COLUMN  = 44                     // narrowest channel column
+	dash_PWMLO   = 900                    // bar graph range
+	dash_PWMHI   = 2100
+)
+
+var phase_names = [...]string{"Unknown", "Disarmed", "Arming", "Armed", "Disarming"}
+
+const dash_KEYS = "p arm  L quit  F f/s  wasdqe sticks  c centre  +- thr  1-0 mode  m combine  [] AUX  ,.<>{}x AUX value  v verbose"
+
+type link_stats struct {
+	sent   int           // MSP_SET_RAW_RC frames
+	acked  int           // and their replies
+	errs   int           // MSP error replies
+	drops  int           // link lost
+	rtt    time.Duration // last MSP_SET_RAW_RC round trip
+	sentt  time.Time
+	rate   float64 // acks/s, over the last second or so
+	wacks  int
+	wstart time.Time
+}
+
+func (s *link_stats) update_rate() {
+	now := time.Now()
+	if s.wstart.IsZero() {
+		s.wstart, s.wacks = now, s.acked
+	} else if dt := now.Sub(s.wstart); dt >= time.Second {
+		s.rate = float64(s.acked-s.wacks) / dt.Seconds()
+		s.wstart, s.wacks = now, s.acked
+	}
+}
+
+// dash_state is what the dashboard shows, from main_rx_loop
+type dash_state struct {
+	phase    int
+	vrc      vRCset
+	tx, prev []byte // last two RC frames sent
+	rx       []byte // MSP_RC reply
+	boxflags uint64
+	armflags uint32
+	linkdown bool
+	auxsel   int
+	modeadd  bool
+	stats    *link_stats
+}
+
+type dash_line struct {
+	text string
+	attr string // SGR parameters for the whole line, "" for none
+}
+
+type dashboard struct {
+	m    *MSPSerial
+	tty  *tty.TTY
+	w, h int
+	last time.Time
+	mu   sync.Mutex // protects logs
+	logs []string
+}
+
+// new_dashboard returns nil if stdout isn't a terminal
+func new_dashboard(m *MSPSerial, t *tty.TTY) *dashboard {
+	fd := os.Stdout.Fd()
+	if !isatty.IsTerminal(fd) && !isatty.IsCygwinTerminal(fd) {
+		return nil
+	}
+	return &dashboard{m: m, tty: t}
+}
+
+func (d *dashboard) start() {
+	d.tty.Output().WriteString("\x1b[?1049h\x1b[?25l\x1b[2J")
+	log.SetOutput(d)
+}
+
+func (d *dashboard) stop() {
+	d.tty.Output().WriteString("\x1b[?25h\x1b[?1049l")
+	log.SetOutput(os.Stderr)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, l := range d.logs {
+		fmt.Fprintln(os.Stderr, l)
+	}
+}
+
+// Write captures the log
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.logs = append(d.logs, l)
+	}
+	if n := len(d.logs) - dash_LOGSIZE; n > 0 {
+		d.logs = append([]string{}, d.logs[n:]...)
+	}
+	return len(p), nil
+}
+
+func (d *dashboard) due() bool {
+	return time.Since(d.last) >= dash_FRAME
+}
+
+func (d *dashboard) draw(st *dash_state) {
+	d.last = time.Now()
+	st.stats.update_rate()
+	w, h, err := d.tty.Size()
+	if err != nil || w < 1 || h < 1 {
+		w, h = 80, 24
+	}
+	var b bytes.Buffer
+	if w != d.w || h != d.h {
+		b.WriteString("\x1b[2J")
+		d.w, d.h = w, h
+	}
+	b.WriteString("\x1b[H")
+	for i, l := range d.render(st, w, h) {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		text := clip(l.text, w)
+		if l.attr != "" {
+			fmt.Fprintf(&b, "\x1b[%sm%s%s\x1b[0m", l.attr, text, strings.Repeat(" ", w-len([]rune(text))))
+		} else {
+			b.WriteString(text)
+			b.WriteString("\x1b[K")
+		}
+	}
+	b.WriteString("\x1b[J")
+	d.tty.Output().Write(b.Bytes())
+}
+
+func clip(s string, w int) string {
+	if r := []rune(s); len(r) > w {
+		return string(r[:w])
+	}
+	return s
+}
+
+func bar(v int16, width int) string {
+	n := (int(v) - dash_PWMLO) * width / (dash_PWMHI - dash_PWMLO)
+	if n < 0 {
+		n = 0
+	} else if n > width {
+		n = width
+	}
+	return "[" + strings.Repeat("=", n) + strings.Repeat(" ", width-n) + "]"
+}
+
+func (d *dashboard) render(st *dash_state, w, h int) []dash_line {
+	m := d.m
+	var lines []dash_line
+	add := func(attr string, format string, args ...interface{}) {
+		lines = append(lines, dash_line{fmt.Sprintf(format, args...), attr})
+	}
+
+	phase := "?"
+	if st.phase >= 0 && st.phase < len(phase_names) {
+		phase = phase_names[st.phase]
+	}
+	add("7", " msp_control [%s]  %s %s  %s  \"%s\"", phase, m.Info.Variant, m.Info.Version, m.Info.BoardID(), m.Info.Name)
+	link := "up"
+	if st.linkdown {
+		link = "DOWN, reconnecting"
+	}
+	s := st.stats
+	add("", "Link: %s  %.1f/s  rtt %.1fms  sent %d  acked %d  errors %d  drops %d  RC:%s",
+		link, s.rate, s.rtt.Seconds()*1000, s.sent, s.acked, s.errs, s.drops, m.rch.state)
+	armattr := ""
+	if st.armflags >= 0x80 {
+		armattr = "33"
+	}
+	add(armattr, "Arming: %s", arm_status(st.armflags))
+	add("", "Boxes: %s", m.format_box(st.boxflags))
+	pending := ""
+	if st.modeadd {
+		pending = " +?"
+	}
+	add("", "Mode: %s%s  Sticks: R:%d P:%d Y:%d T:%d", m.mode_label(), pending,
+		st.vrc.roll, st.vrc.pitch, st.vrc.yaw, st.vrc.thr)
+	add("", "")
+
+	// Channels, in as many columns as needed and will fit
+	tx := m.deserialise_rx(st.tx)
+	prev := m.deserialise_rx(st.prev)
+	echo := make([]int16, len(tx))
+	have := make([]bool, len(tx))
+	for i, v := range m.deserialise_rx(st.rx) {
+		c := i
+		if i < 4 {
+			c = m.stick_chan(i)
+		}
+		if c < len(echo) {
+			echo[c], have[c] = v, true
+		}
+	}
+	labels := make([]string, len(tx))
+	for i := 0; i < 4; i++ {
+		if c := m.stick_chan(i); c < len(labels) {
+			labels[c] = string("AERT"[i])
+		}
+	}
+	if c := int(m.armchan); c >= 0 && c < len(labels) {
+		labels[c] = "ARM"
+	}
+	rows := h - dash_TOP - 2 - dash_MINLOG
+	if rows < 1 {
+		rows = 1
+	}
+	ncol := 1
+	for ncol*rows < len(tx) && w/(ncol+1) >= dash_COLUMN {
+		ncol++
+	}
+	if rows*ncol > len(tx) {
+		rows = (len(tx) + ncol - 1) / ncol
+	}
+	colw := w / ncol
+	bw := (colw - 26) / 2
+	if bw > 50 {
+		bw = 50
+	} else if bw < 1 {
+		bw = 1
+	}
+	head := fmt.Sprintf("  Ch      Sent %s  Echo", strings.Repeat(" ", bw+1))
+	add("1", "%s", strings.TrimRight(strings.Repeat(fmt.Sprintf("%-*s", colw, head), ncol), " "))
+	shown := rows * ncol
+	for r := 0; r < rows; r++ {
+		var row []string
+		attr := ""
+		for k := 0; k < ncol; k++ {
+			c := k*rows + r
+			if c >= len(tx) {
+				break
+			}
+			if c == shown-1 && shown < len(tx) {
+				row = append(row, fmt.Sprintf("  ... %d more channels", len(tx)-c))
+				break
+			}
+			sel := ' '
+			if c+1 == st.auxsel {
+				sel = '>'
+			}
+			es, eb, bad := "   -", "", ' '
+			if have[c] {
+				es, eb = fmt.Sprintf("%4d", echo[c]), bar(echo[c], bw)
+				if !rc_near(echo[c], tx[c]) && (c >= len(prev) || !rc_near(echo[c], prev[c])) {
+					bad, attr = '!', "31"
+				}
+			}
+			row = append(row, fmt.Sprintf("%-*s", colw, fmt.Sprintf("%c%2d %-3s %4d %s %s%c%s",
+				sel, c+1, labels[c], tx[c], bar(tx[c], bw), es, bad, eb)))
+		}
+		add(attr, "%s", strings.TrimRight(strings.Join(row, ""), " "))
+	}
+
+	// Log, to the foot of the screen
+	add("2", "-- log %s", strings.Repeat("-", w))
+	nlog := h - len(lines) - 1
+	if nlog < 0 {
+		nlog = 0
+	}
+	d.mu.Lock()
+	start := len(d.logs) - nlog
+	if start < 0 {
+		start = 0
+	}
+	for _, l := range d.logs[start:] {
+		add("", "%s", strings.TrimPrefix(l, log_prefix))
+	}
+	d.mu.Unlock()
+	for len(lines) < h-1 {
+		add("", "")
+	}
+	add("7", " %s", dash_KEYS)
+	if len(lines) > h { // a very small terminal
+		lines = lines[:h]
+	}
+	return lines
+}
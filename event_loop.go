@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/TByte007/msp_control/msp"
 	"github.com/mattn/go-tty"
 )
 
@@ -24,60 +25,110 @@ const max_stick = 300
 
 // Virtual RC settings
 type vRCset struct {
-	thr   int // Throttle
-	roll  int
-	pitch int
-	yaw   int
-	fs    bool // Failsafe
+	thr    int // Throttle
+	roll   int
+	pitch  int
+	yaw    int
+	fs     bool // Failsafe
+	bypass bool // Arm with the NavUnsafe bypass (yaw held high)
 }
 
-func get_status(v SChan) (status uint64, armflags uint32) {
-	if v.cmd == msp2_INAV_STATUS {
-		status = binary.LittleEndian.Uint64(v.data[13:21])
+// can_bypass is true if NavUnsafe is the only arming blocker and the FC
+// allows it to be bypassed (nav_extra_arming_safety = ALLOW_BYPASS)
+func (m *MSPSerial) can_bypass(armflags uint32) bool {
+	return m.bypass && armflags&^0x7f == armflag_NAV_UNSAFE
+}
+
+func start_arming(vrc *vRCset, bypass bool) {
+	vrc.bypass = bypass
+	if bypass {
+		log.Println("Arming with the NavUnsafe bypass (yaw held high)")
 	} else {
-		status = uint64(binary.LittleEndian.Uint32(v.data[6:10]))
+		log.Println("Arming commanded")
 	}
+}
 
-	if v.cmd == msp_STATUS_EX {
-		armflags = uint32(binary.LittleEndian.Uint16(v.data[13:15]))
-	} else {
-		armflags = binary.LittleEndian.Uint32(v.data[9:13])
+// Status inquiries, most capable first
+var status_cmds = []uint16{msp.INAV_STATUS, msp.STATUS_EX, msp.STATUS}
+
+// MSP_STATUS has no arming flags, these are reported as 0
+func get_status(v SChan) (status uint64, armflags uint32) {
+	switch v.cmd {
+	case msp.INAV_STATUS:
+		if len(v.data) >= 21 {
+			status = binary.LittleEndian.Uint64(v.data[13:21])
+			armflags = binary.LittleEndian.Uint32(v.data[9:13])
+		}
+	case msp.STATUS_EX:
+		if len(v.data) >= 15 {
+			status = uint64(binary.LittleEndian.Uint32(v.data[6:10]))
+			armflags = uint32(binary.LittleEndian.Uint16(v.data[13:15]))
+		}
+	default:
+		if len(v.data) >= 10 {
+			status = uint64(binary.LittleEndian.Uint32(v.data[6:10]))
+		}
 	}
 	return status, armflags
 }
 
-func (m *MSPSerial) find_status_cmd() (stscmd uint16) {
-	// MSP STatus inquiry, INAV version dependent
-	if m.vcapi > 0x200 {
-		if m.fcvers >= 0x010801 {
-			stscmd = msp2_INAV_STATUS
-		} else {
-			stscmd = msp_STATUS_EX
+// next_status_cmd returns the fallback for a rejected status command
+func next_status_cmd(stscmd uint16) (uint16, bool) {
+	for i := 0; i < len(status_cmds)-1; i++ {
+		if status_cmds[i] == stscmd {
+			return status_cmds[i+1], true
 		}
-	} else {
-		stscmd = msp_STATUS
 	}
-	return stscmd
+	return stscmd, false
 }
 
-func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
+func (m *MSPSerial) find_status_cmd() uint16 {
+	// MSP Status inquiry, as probed by MSPInit
+	switch {
+	case m.caps.Has(CAP_INAV_STATUS):
+		return msp.INAV_STATUS
+	case m.caps.Has(CAP_STATUS_EX):
+		return msp.STATUS_EX
+	default:
+		return msp.STATUS
+	}
+}
+
+func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool, giveup time.Duration, plain bool) {
 	phase := PHASE_Quiescent
 	stscmd := m.find_status_cmd()
 	xboxflags := uint64(0)
 	xarmflags := uint32(0)
 	dpending := false
+	linkdown := false
+	rschan := make(chan resume_result, 1)
 
 	vrc := vRCset{ // Virtual RC
 		thr: setthr,
 		fs:  false,
 	}
 
+	if m.set_modes(m.cmodes) != nil { // default, if the FC has a range for it
+		m.cmodes = nil
+	}
+	modeadd := false
+	auxsel := m.next_aux(m.nchan, 1) // first AUX channel
+	var lasttx, prevtx []byte        // for the mode predictor and RC check
+	var lastrx []byte                // MSP_RC echo
+	rcevery, nrc := m.rc_every(), 0  // RC frames per echo request
+	stats := &link_stats{}
+
 	tty, err := tty.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer tty.Close()
 
+	var dash *dashboard
+	if !plain {
+		dash = new_dashboard(m, tty)
+	}
+
 	evchan := make(chan rune)
 	go func() {
 		for {
@@ -92,12 +143,22 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 	cc := make(chan os.Signal, 1)
 	signal.Notify(cc, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	fmt.Println("Keypresses: 'p'/'P': toggle arming, 'L': quit, 'F': quit to failsafe")
-	fmt.Println("            '+'/'-' raise / lower throttle by 25µs")
-	fmt.Println("            'c'/'C' Center sticks")
-	fmt.Println("            'a'<=>'d' Roll")
-	fmt.Println("            'w'<=>'s' Pitch")
-	fmt.Println("            'q'<=>'e' Yaw")
+	if dash != nil {
+		dash.start()
+		defer dash.stop()
+	} else {
+		fmt.Println("Keypresses: 'p'/'P': toggle arming, 'L': quit, 'F': quit to failsafe")
+		fmt.Println("            '+'/'-' raise / lower throttle by 25µs")
+		fmt.Println("            'c'/'C' Center sticks")
+		fmt.Println("            'a'<=>'d' Roll")
+		fmt.Println("            'w'<=>'s' Pitch")
+		fmt.Println("            'q'<=>'e' Yaw")
+		fmt.Println("            '1'-'0' Flight mode: ANGLE, HORIZON, MANUAL, ALTHOLD, POSHOLD,")
+		fmt.Println("                    RTH, WP, CRUISE, COURSE HOLD, LAUNCH")
+		fmt.Println("            'm' then '1'-'0' Add / remove a mode to the selection")
+		fmt.Println("            '['/']' Select AUX channel, ','/'.' '<'/'>' step it by 25 / 100µs,")
+		fmt.Println("                    '{'/'}' set it to 1000 / 2000µs, 'x' to its default")
+	}
 	log.Printf("Start TX loop")
 
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -105,43 +166,85 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 	for done := false; !done; {
 		select {
 		case <-ticker.C:
-			tdata := m.serialise_rx(phase, vrc)
-			m.Send_msp(msp_SET_RAW_RC, tdata)
+			if linkdown {
+				break
+			}
+			tdata, err := m.serialise_rx(phase, vrc)
+			if err != nil {
+				log.Printf("RC: %v\n", err)
+				done = true
+				break
+			}
+			m.Send_msp(msp.SET_RAW_RC, tdata)
+			prevtx, lasttx = lasttx, tdata
+			stats.sent++
+			stats.sentt = time.Now()
 			if verbose {
-				txdata := deserialise_rx(tdata)
+				txdata := m.deserialise_rx(tdata)
 				log.Printf("Tx: %v\n", txdata)
 			}
 		case v := <-m.c0:
-			if v.ok {
+			if v.cmd == msp_TRANSPORT_FAIL {
+				if linkdown {
+					break
+				}
+				stats.drops++
+				if giveup > 0 {
+					log.Println("Link lost, reconnecting")
+					linkdown = true
+					go func() {
+						s, err := m.Reconnect(giveup, stscmd)
+						rschan <- resume_result{s, err}
+					}()
+				} else {
+					log.Println("Link lost")
+					done = true
+				}
+			} else if v.ok {
 				switch v.cmd {
-				case msp_SET_RAW_RC:
-					if verbose {
-						m.Send_msp(msp_RC, nil)
+				case msp.SET_RAW_RC:
+					stats.acked++
+					stats.rtt = time.Since(stats.sentt)
+					nrc++
+					if !m.is_rejected(msp.RC) && nrc%rcevery == 0 {
+						m.Send_msp(msp.RC, nil)
 					} else {
 						m.Send_msp(stscmd, nil)
 					}
-				case msp_RC:
-					rxdata := deserialise_rx(v.data)
-					log.Printf("Rx: %v\n", rxdata)
+				case msp.RC:
+					if verbose {
+						rxdata := m.deserialise_rx(v.data)
+						log.Printf("Rx: %v\n", rxdata)
+					}
+					m.check_rc(lasttx, prevtx, v.data)
+					lastrx = v.data
 					m.Send_msp(stscmd, nil)
 
-				case msp2_INAV_STATUS, msp_STATUS_EX, msp_STATUS:
+				case msp.INAV_STATUS, msp.STATUS_EX, msp.STATUS:
 					boxflags, armflags := get_status(v)
+					m.verify_mode(boxflags)
+					m.check_modes(lasttx, boxflags)
 					if boxflags != xboxflags || xarmflags != armflags {
 						log.Printf("Box: %s (%x) Arm: %s\n", m.format_box(boxflags), boxflags, arm_status(armflags))
 						vrc.fs = ((boxflags & m.fail_mask) == m.fail_mask)
 						if boxflags&m.arm_mask == 0 { // not armed
-							if armflags < 0x80 { // ready to arm
+							bypass := m.can_bypass(armflags)
+							if armflags < 0x80 || bypass { // ready to arm
 								if autoarm {
 									phase = PHASE_Arming
+									start_arming(&vrc, bypass)
 									autoarm = false
-								} else {
+								} else if phase != PHASE_Arming {
 									phase = PHASE_Quiescent
 									done = dpending
 								}
 							}
 						} else { // Armed
 							phase = PHASE_LowThrottle
+							if vrc.bypass { // the yaw stick was only overridden in the frame
+								log.Printf("Armed using the NavUnsafe bypass, yaw returned to %d\n", vrc.yaw)
+								vrc.bypass = false
+							}
 						}
 						xboxflags = boxflags
 						xarmflags = armflags
@@ -149,8 +252,47 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 				default:
 				}
 			} else {
-				log.Printf("MSP %d (%x) failed\n", v.cmd, v.cmd)
+				// The FC rejected a command; note it, fall back if
+				// possible and keep the RC flowing regardless
+				first := m.reject(v.cmd)
+				stats.errs++
+				if first {
+					log.Printf("MSP %d (%x) rejected by FC\n", v.cmd, v.cmd)
+				}
+				switch v.cmd {
+				case msp.INAV_STATUS, msp.STATUS_EX, msp.STATUS:
+					if nc, ok := next_status_cmd(v.cmd); ok {
+						log.Printf("Status: falling back from %d to %d\n", v.cmd, nc)
+						stscmd = nc
+					} else if first {
+						log.Println("No status command accepted, FC state unknown")
+					}
+				case msp.SET_RAW_RC:
+					if first {
+						log.Println("MSP_SET_RAW_RC rejected, is receiver_type MSP?")
+					}
+					m.Send_msp(stscmd, nil)
+				case msp.RC:
+					m.Send_msp(stscmd, nil)
+				}
+			}
+
+		case rs := <-rschan:
+			linkdown = false
+			if rs.err != nil {
+				log.Printf("Reconnect: %v\n", rs.err)
 				done = true
+			} else {
+				phase = m.resume(rs.sess)
+				if phase == PHASE_LowThrottle {
+					log.Println("Link restored, FC still armed")
+				} else {
+					log.Println("Link restored")
+				}
+				xboxflags, xarmflags = 0, 0
+				lasttx, prevtx, lastrx = nil, nil, nil
+				m.rch = rc_health{}
+				done = dpending && phase != PHASE_LowThrottle
 			}
 
 		case ev := <-evchan:
@@ -158,8 +300,8 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 			case 'p', 'P':
 				switch phase {
 				case PHASE_Quiescent:
-					log.Println("Arming commanded")
 					phase = PHASE_Arming
+					start_arming(&vrc, m.can_bypass(xarmflags))
 				case PHASE_LowThrottle:
 					log.Println("Disarming commanded")
 					phase = PHASE_Disarming
@@ -171,10 +313,33 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 			case 'L':
 				log.Println("Quit commanded")
 				phase, done, dpending = safe_quit(phase)
+				done = done || linkdown
 			case 'v', 'V':
 				verbose = !verbose
-			case '5':
-
+			case '1', '2', '3', '4', '5', '6', '7', '8', '9', '0':
+				permid, _ := key_mode(ev)
+				var err error
+				if modeadd {
+					err = m.toggle_mode(permid)
+				} else {
+					err = m.set_modes([]byte{permid})
+				}
+				modeadd = false
+				if err != nil {
+					log.Printf("Mode: %v\n", err)
+				} else {
+					log.Printf("Mode %s selected\n", m.mode_label())
+				}
+			case 'm', 'M':
+				modeadd = true
+			case '[':
+				auxsel = m.next_aux(auxsel, -1)
+				log.Printf("AUX channel %d selected (%dus)\n", auxsel, m.aux_value(byte(auxsel-5)))
+			case ']':
+				auxsel = m.next_aux(auxsel, 1)
+				log.Printf("AUX channel %d selected (%dus)\n", auxsel, m.aux_value(byte(auxsel-5)))
+			case ',', '.', '<', '>', '{', '}', 'x', 'X':
+				m.aux_key(ev, auxsel)
 			case '+', '=':
 				vrc.thr += 25
 				if vrc.thr > 2000 {
@@ -222,10 +387,19 @@ func (m *MSPSerial) main_rx_loop(setthr int, verbose bool, autoarm bool) {
 		case <-cc:
 			log.Println("Interrupt")
 			phase, done, dpending = safe_quit(phase)
+			done = done || linkdown
+		}
+		if dash != nil {
+			if dash.due() {
+				dash.draw(&dash_state{phase: phase, vrc: vrc, tx: lasttx, prev: prevtx, rx: lastrx,
+					boxflags: xboxflags, armflags: xarmflags, linkdown: linkdown,
+					auxsel: auxsel, modeadd: modeadd, stats: stats})
+			}
+			continue
 		}
 		fmt.Printf("\r")
-		fmt.Printf("[R:%d, P:%d, Y:%d, T:%d]",
-			vrc.roll, vrc.pitch, vrc.yaw, vrc.thr)
+		fmt.Printf("[R:%d, P:%d, Y:%d, T:%d] %s ch%d:%d RC:%s",
+			vrc.roll, vrc.pitch, vrc.yaw, vrc.thr, m.mode_label(), auxsel, m.aux_value(byte(auxsel-5)), m.rch.state)
 	}
 }
 
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// send_rc sends RC frames to the mock, returning the FC's arming flags
+func send_rc(t *testing.T, m *MSPSerial, phase int, vrc vRCset) uint32 {
+	t.Helper()
+	buf, err := m.serialise_rx(phase, vrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Transact(msp.SET_RAW_RC, buf, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	v, err := m.Transact(msp.INAV_STATUS, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, armflags := get_status(v)
+	return armflags
+}
+
+// mock_link_up makes the mock's RC link stable, without waiting for it
+func mock_link_up(m *MSPSerial) {
+	fc := m.sd.(*MockFC)
+	fc.mu.Lock()
+	fc.linkup = time.Now().Add(-time.Second)
+	fc.mu.Unlock()
+}
+
+func TestArming(t *testing.T) {
+	tests := []struct {
+		profile string
+		armed   bool
+	}{
+		{"inav7", true},
+		{"nogps", true}, // with the bypass
+		{"nobypass", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			m := mock_init(t, tt.profile)
+			vrc := vRCset{yaw: -40}
+			send_rc(t, m, PHASE_Quiescent, vrc)
+			mock_link_up(m)
+			armflags := send_rc(t, m, PHASE_Quiescent, vrc)
+			if armflags&armflag_ARMED != 0 {
+				t.Fatalf("armed while disarmed: %s", arm_status(armflags))
+			}
+			start_arming(&vrc, m.can_bypass(armflags))
+			armflags = send_rc(t, m, PHASE_Arming, vrc)
+			if armed := armflags&armflag_ARMED != 0; armed != tt.armed {
+				t.Fatalf("armed %v, want %v: %s", armed, tt.armed, arm_status(armflags))
+			}
+			if !tt.armed {
+				return
+			}
+			if vrc.yaw != -40 {
+				t.Errorf("yaw %d after arming", vrc.yaw)
+			}
+			if armflags = send_rc(t, m, PHASE_Disarming, vrc); armflags&armflag_ARMED != 0 {
+				t.Errorf("still armed after disarming: %s", arm_status(armflags))
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// FCInfo is the FC identity, as gathered by MSPInit
+type FCInfo struct {
+	Variant      string        `json:"variant"`
+	Version      string        `json:"version"`
+	API          string        `json:"api"`
+	Board        string        `json:"board"`
+	HWRevision   uint16        `json:"hw_revision"`
+	Target       string        `json:"target"`
+	GitRev       string        `json:"gitrev"`
+	BuildTime    time.Time     `json:"build_time"`
+	Name         string        `json:"name"`
+	RxMap        string        `json:"rx_map"`
+	Channels     int           `json:"rc_channels"`
+	Boxes        []string      `json:"boxes"`
+	ModeRanges   []FCModeRange `json:"mode_ranges"`
+	ArmingSafety int           `json:"nav_extra_arming_safety"` // the FC's value, -1 if unknown
+	// OFF, ON or ALLOW_BYPASS, whatever the firmware's numbering
+	ArmingSafetyName string `json:"nav_extra_arming_safety_name,omitempty"`
+	Bypass           bool   `json:"bypass"`
+}
+
+type FCModeRange struct {
+	Mode    string `json:"mode"`
+	PermID  uint8  `json:"permid"`
+	Channel int    `json:"channel"`
+	Min     uint16 `json:"min"`
+	Max     uint16 `json:"max"`
+}
+
+// BoardID is the full board identifier, e.g. "SPEV/SPEEDYBEEF405V4 rev 0"
+func (f *FCInfo) BoardID() string {
+	id := f.Board
+	if f.Target != "" {
+		id += "/" + f.Target
+	}
+	return fmt.Sprintf("%s rev %d", id, f.HWRevision)
+}
+
+// set_build parses MSP_BUILD_INFO: date (11, "Jan  2 2006"), time (8), git revision
+func (f *FCInfo) set_build(data []byte) {
+	if len(data) < 19 {
+		return
+	}
+	if t, err := time.Parse("Jan _2 200615:04:05", string(data[:19])); err == nil {
+		f.BuildTime = t
+	}
+	f.GitRev = strings.TrimRight(string(data[19:]), "\x00")
+}
+
+// set_board parses MSP_BOARD_INFO: identifier (4), hardware revision
+// (u16), OSD type, comms capabilities, target name length and name
+func (f *FCInfo) set_board(data []byte) {
+	if len(data) < 4 {
+		return
+	}
+	f.Board = string(data[0:4])
+	if len(data) >= 6 {
+		f.HWRevision = binary.LittleEndian.Uint16(data[4:6])
+	}
+	if len(data) > 8 {
+		n := int(data[8])
+		if n > len(data)-9 {
+			n = len(data) - 9
+		}
+		f.Target = string(data[9 : 9+n])
+	}
+}
+
+func (m *MSPSerial) set_info_ranges() {
+	m.Info.ModeRanges = m.Info.ModeRanges[:0]
+	for _, r := range m.mranges {
+		m.Info.ModeRanges = append(m.Info.ModeRanges, FCModeRange{Mode: m.mode_name(r.boxid),
+			PermID: r.boxid, Channel: int(r.chanidx) + 5,
+			Min: make_pwm(r.start), Max: make_pwm(r.end)})
+	}
+}
+
+func (f *FCInfo) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+func (f *FCInfo) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Firmware:  %s %s (API %s)\n", f.Variant, f.Version, f.API)
+	fmt.Fprintf(w, "Board:     %s\n", f.BoardID())
+	if f.BuildTime.IsZero() {
+		fmt.Fprintf(w, "Build:     %s\n", f.GitRev)
+	} else {
+		fmt.Fprintf(w, "Build:     %s %s\n", f.BuildTime.Format("2006-01-02 15:04:05"), f.GitRev)
+	}
+	fmt.Fprintf(w, "Name:      %s\n", f.Name)
+	fmt.Fprintf(w, "RX map:    %s\n", f.RxMap)
+	fmt.Fprintf(w, "Channels:  %d\n", f.Channels)
+	if f.ArmingSafety < 0 {
+		fmt.Fprintf(w, "%s: unknown\n", SETTING_STR)
+	} else {
+		fmt.Fprintf(w, "%s: %d %s (bypass %v)\n", SETTING_STR, f.ArmingSafety, f.ArmingSafetyName, f.Bypass)
+	}
+	fmt.Fprintf(w, "Boxes:     %s\n", strings.Join(f.Boxes, ", "))
+	fmt.Fprintln(w, "Mode ranges:")
+	for _, r := range f.ModeRanges {
+		fmt.Fprintf(w, "  chan: %2d, start: %d, end: %d %s\n", r.Channel, r.Min, r.Max, r.Mode)
+	}
+}
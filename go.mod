@@ -3,7 +3,7 @@ module github.com/TByte007/msp_control
 go 1.14
 
 require (
-	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-isatty v0.0.20
 	github.com/mattn/go-tty v0.0.5
 	go.bug.st/serial v1.6.2
 	golang.org/x/sys v0.18.0
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// An in-process mock INAV FC, implementing SerDev. It answers the
+// identification queries from a profile and models the arming flags,
+// box flags, RC link / failsafe timing and the ARM switch, which is
+// enough to exercise MSPInit and main_rx_loop without hardware.
+
+const (
+	mock_LINK_TIMEOUT  = 200 * time.Millisecond // RC older than this is a lost link
+	mock_FS_RECOVERY   = 500 * time.Millisecond // failsafe clears after link good for this
+	mock_RCLINK_STABLE = 600 * time.Millisecond
+	mock_MIN_CHECK     = 1100
+	mock_BYPASS_YAW    = 1750
+)
+
+type mock_box struct {
+	name   string
+	permid byte
+}
+
+type MockProfile struct {
+	variant   string
+	version   [3]byte
+	api       [2]byte
+	board     string
+	target    string
+	gitrev    string
+	name      string
+	boxes     []mock_box
+	ranges    []ModeRange
+	rxmap     [4]byte
+	fcmap     [4]byte   // map the FC actually uses (normally rxmap)
+	rxrange   [2]uint16 // stick range scaled to 1000-2000, if set
+	otherrx   bool      // RC from another receiver, MSP RC values ignored
+	nchan     int
+	navunsafe bool // no GPS fix with nav modes configured
+	settings  []*mock_setting
+	rejects   []uint16 // commands answered with an error
+}
+
+var inav7_boxes = []mock_box{
+	{"ARM", 0}, {"PREARM", 51}, {"MULTI FUNCTION", 61}, {"ANGLE", 1}, {"HORIZON", 2},
+	{"TURN ASSIST", 35}, {"HEADING HOLD", 5}, {"CAMSTAB", 8}, {"NAV POSHOLD", 11},
+	{"LOITER CHANGE", 49}, {"NAV RTH", 10}, {"NAV WP", 28}, {"NAV CRUISE", 53},
+	{"NAV COURSE HOLD", 45}, {"HOME RESET", 30}, {"GCS NAV", 31}, {"WP PLANNER", 55},
+	{"MISSION CHANGE", 59}, {"SOARING", 56}, {"NAV ALTHOLD", 3}, {"MANUAL", 12},
+	{"NAV LAUNCH", 36}, {"SERVO AUTOTRIM", 37}, {"AUTO TUNE", 21}, {"AUTO LEVEL TRIM", 54},
+	{"BEEPER", 13}, {"BEEPER MUTE", 60}, {"OSD OFF", 19}, {"BLACKBOX", 26},
+	{"KILLSWITCH", 38}, {"FAILSAFE", 27}, {"CAMERA CONTROL 1", 39}, {"CAMERA CONTROL 2", 40},
+	{"CAMERA CONTROL 3", 41}, {"OSD ALT 1", 42}, {"OSD ALT 2", 43}, {"OSD ALT 3", 44},
+	{"MIXER PROFILE 2", 62}, {"MIXER TRANSITION", 63},
+}
+
+type mock_setting struct {
+	name  string
+	typ   byte
+	min   int32
+	max   uint32
+	table []string
+	value []byte
+}
+
+// A few settings of each type; arming is the nav_extra_arming_safety value
+func mock_settings(arming byte) []*mock_setting {
+	return []*mock_setting{
+		{"receiver_type", setting_UINT8, 0, 3, []string{"NONE", "SERIAL", "MSP", "SIM (SITL)"}, []byte{2}},
+		{"failsafe_procedure", setting_UINT8, 0, 3, []string{"LAND", "DROP", "RTH", "NONE"}, []byte{2}},
+		{"small_angle", setting_UINT8, 0, 180, nil, []byte{25}},
+		{"mag_declination", setting_INT16, -18000, 18000, nil, []byte{0, 0}},
+		{"nav_rth_altitude", setting_UINT32, 0, 65000, nil, []byte{0xb8, 0x0b, 0, 0}},
+		{"throttle_idle", setting_FLOAT, 0, 30, nil, []byte{0, 0, 0x70, 0x41}},
+		{SETTING_STR, setting_UINT8, 0, 1, []string{"ON", "ALLOW_BYPASS"}, []byte{arming}},
+		{"name", setting_STRING, 0, 16, nil, []byte("BENCHYMCTESTY")},
+	}
+}
+
+// As the README example
+var inav7_ranges = []ModeRange{
+	{boxid: PERM_POSHOLD, chanidx: 0, start: 16, end: 32},
+	{boxid: PERM_RTH, chanidx: 0, start: 32, end: 48},
+	{boxid: PERM_WP, chanidx: 1, start: 16, end: 48},
+	{boxid: PERM_ALTHOLD, chanidx: 2, start: 32, end: 48},
+	{boxid: PERM_COURSE_HOLD, chanidx: 2, start: 32, end: 48},
+	{boxid: PERM_LAUNCH, chanidx: 3, start: 19, end: 28},
+	{boxid: PERM_ARM, chanidx: 5, start: 24, end: 48},
+	{boxid: PERM_MANUAL, chanidx: 6, start: 22, end: 48},
+	{boxid: 13, chanidx: 7, start: 28, end: 48}, // BEEPER
+}
+
+func mock_profile(name string) (*MockProfile, error) {
+	p := &MockProfile{
+		variant:  "INAV",
+		version:  [3]byte{7, 0, 0},
+		api:      [2]byte{2, 5},
+		board:    "MOCK",
+		target:   "MOCKFC",
+		gitrev:   "0000000",
+		name:     "BENCHYMCTESTY",
+		boxes:    inav7_boxes,
+		ranges:   inav7_ranges,
+		rxmap:    [4]byte{0, 1, 3, 2}, // AETR
+		fcmap:    [4]byte{0, 1, 3, 2},
+		nchan:    18,
+		settings: mock_settings(1), // ALLOW_BYPASS (v6+)
+	}
+	switch name {
+	case "", "inav7":
+	case "inav6":
+		p.version = [3]byte{6, 1, 1}
+		p.boxes = inav7_boxes[:len(inav7_boxes)-2]
+	case "nogps":
+		p.navunsafe = true
+	case "nobypass":
+		p.navunsafe = true
+		p.settings = mock_settings(0)
+	case "wide":
+		p.nchan = 34
+	case "badmap":
+		p.fcmap = [4]byte{1, 2, 3, 0} // TAER
+	case "rxrange":
+		p.rxrange = [2]uint16{1050, 1950}
+	case "otherrx":
+		p.otherrx = true
+	case "legacy":
+		p.rejects = []uint16{msp.INAV_STATUS}
+	case "noarm", "badarm", "fararm":
+		p.ranges = nil
+		for _, r := range inav7_ranges {
+			if r.boxid != PERM_ARM {
+				p.ranges = append(p.ranges, r)
+			}
+		}
+		if name == "badarm" { // always on
+			p.ranges = append(p.ranges, ModeRange{boxid: PERM_ARM, chanidx: 5, start: 0, end: 48})
+		} else if name == "fararm" { // AUX17, beyond the 18 channels
+			p.ranges = append(p.ranges, ModeRange{boxid: PERM_ARM, chanidx: 16, start: 24, end: 48})
+		}
+	default:
+		return nil, fmt.Errorf("unknown mock profile \"%s\" (inav7, inav6, nogps, nobypass, wide, badmap, rxrange, otherrx, legacy, noarm, badarm, fararm)", name)
+	}
+	// all the slots, so MSP_SET_MODE_RANGE can write any of them
+	slots := make([]ModeRange, MAX_MODE_ACTIVATION_CONDITION_COUNT)
+	copy(slots, p.ranges)
+	p.ranges = slots
+	return p, nil
+}
+
+type MockFC struct {
+	p      *MockProfile
+	pw     *io.PipeWriter
+	outc   chan []byte
+	pend   []byte
+	done   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	rc     []uint16 // as received, unmapped
+	lastrc time.Time
+	linkup time.Time // start of the current run of good RC
+	armed  bool
+	ever   bool
+	swoff  bool // ARM switch seen off since last blocked
+}
+
+func NewMockFC(profile string) (*MockFC, error) {
+	p, err := mock_profile(profile)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	m := &MockFC{p: p, pw: pw, outc: make(chan []byte, 64), done: make(chan struct{}),
+		rc: make([]uint16, p.nchan)}
+	for i := range m.rc {
+		m.rc[i] = 1500
+	}
+	go m.serve(pr)
+	return m, nil
+}
+
+func (m *MockFC) Read(buf []byte) (int, error) {
+	if len(m.pend) == 0 {
+		select {
+		case b := <-m.outc:
+			m.pend = b
+		case <-m.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(buf, m.pend)
+	m.pend = m.pend[n:]
+	return n, nil
+}
+
+func (m *MockFC) Write(buf []byte) (int, error) {
+	select {
+	case <-m.done:
+		return 0, errors.New("mock FC closed")
+	default:
+	}
+	return m.pw.Write(buf)
+}
+
+func (m *MockFC) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		m.pw.Close()
+	})
+	return nil
+}
+
+func (m *MockFC) serve(r io.Reader) {
+	dec := msp.NewDecoder(r)
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			var cerr *msp.CRCError
+			if errors.As(err, &cerr) {
+				continue
+			}
+			return
+		}
+		if f.Dirn != msp.ToFC {
+			continue
+		}
+		payload, ok := m.handle(f.Cmd, f.Payload)
+		dirn := byte(msp.FromFC)
+		if !ok {
+			dirn = msp.Error
+			payload = nil
+		}
+		select {
+		case m.outc <- msp.Encode(msp.Frame{Version: f.Version, Dirn: dirn, Cmd: f.Cmd, Payload: payload}):
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *MockFC) handle(cmd uint16, data []byte) ([]byte, bool) {
+	p := m.p
+	for _, c := range p.rejects {
+		if c == cmd {
+			return nil, false
+		}
+	}
+	switch cmd {
+	case msp.API_VERSION:
+		return []byte{0, p.api[0], p.api[1]}, true
+	case msp.FC_VARIANT:
+		return []byte(p.variant), true
+	case msp.FC_VERSION:
+		return p.version[:], true
+	case msp.BOARD_INFO:
+		b := make([]byte, 9, 9+len(p.target))
+		copy(b, p.board)
+		b[8] = byte(len(p.target))
+		return append(b, p.target...), true
+	case msp.BUILD_INFO:
+		return []byte("Jan  1 2024" + "12:00:00" + p.gitrev), true
+	case msp.NAME:
+		return []byte(p.name), true
+	case msp.BOXNAMES:
+		var sb strings.Builder
+		for _, b := range p.boxes {
+			sb.WriteString(b.name)
+			sb.WriteByte(';')
+		}
+		return []byte(sb.String()), true
+	case msp.BOXIDS:
+		b := make([]byte, len(p.boxes))
+		for i, bx := range p.boxes {
+			b[i] = bx.permid
+		}
+		return b, true
+	case msp.MODE_RANGES:
+		b := make([]byte, MAX_MODE_ACTIVATION_CONDITION_COUNT*4)
+		for i, r := range p.ranges {
+			copy(b[i*4:], []byte{r.boxid, r.chanidx, r.start, r.end})
+		}
+		return b, true
+	case msp.SET_MODE_RANGE:
+		if len(data) < 5 || int(data[0]) >= len(p.ranges) {
+			return nil, false
+		}
+		p.ranges[data[0]] = ModeRange{boxid: data[1], chanidx: data[2], start: data[3], end: data[4]}
+		return nil, true
+	case msp.RX_MAP:
+		return p.rxmap[:], true
+	case msp.COMMON_SETTING_INFO, msp.COMMON_SETTING, msp.COMMON_SET_SETTING:
+		return m.setting(cmd, data)
+	case msp.EEPROM_WRITE:
+		return nil, true
+	case msp.SET_RAW_RC:
+		m.set_rc(data)
+		return nil, true
+	case msp.RC:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		b := make([]byte, 2*p.nchan)
+		for i := 0; i < p.nchan; i++ {
+			binary.LittleEndian.PutUint16(b[i*2:], m.channel(i))
+		}
+		return b, true
+	case msp.STATUS, msp.STATUS_EX, msp.INAV_STATUS:
+		return m.status(cmd), true
+	}
+	return nil, false
+}
+
+func (p *MockProfile) bypass() bool {
+	for _, ms := range p.settings {
+		if ms.name == SETTING_STR {
+			return ms.value[0] == 1
+		}
+	}
+	return false
+}
+
+// setting handles the common setting commands; a setting is identified
+// by name or, after a leading 0, by u16 index
+func (m *MockFC) setting(cmd uint16, data []byte) ([]byte, bool) {
+	var ms *mock_setting
+	var idx int
+	n := bytes.IndexByte(data, 0)
+	switch {
+	case n < 0:
+		return nil, false
+	case n == 0 && len(data) >= 3:
+		idx = int(binary.LittleEndian.Uint16(data[1:3]))
+		if idx < len(m.p.settings) {
+			ms = m.p.settings[idx]
+		}
+		data = data[3:]
+	default:
+		for i, s := range m.p.settings {
+			if s.name == string(data[:n]) {
+				ms, idx = s, i
+			}
+		}
+		data = data[n+1:]
+	}
+	if ms == nil {
+		return nil, false
+	}
+	switch cmd {
+	case msp.COMMON_SETTING:
+		return ms.value, true
+	case msp.COMMON_SET_SETTING:
+		if ms.typ == setting_STRING {
+			ms.value = append([]byte{}, data...)
+		} else if len(data) == len(ms.value) {
+			copy(ms.value, data)
+		} else {
+			return nil, false
+		}
+		return nil, true
+	}
+	b := append([]byte(ms.name), 0)
+	b = append(b, 0, 0, ms.typ, 0, 0)
+	if ms.table != nil {
+		b[len(b)-1] = setting_MODE_LOOKUP
+	}
+	b = append(b, make([]byte, 12)...)
+	binary.LittleEndian.PutUint32(b[len(b)-12:], uint32(ms.min))
+	binary.LittleEndian.PutUint32(b[len(b)-8:], ms.max)
+	binary.LittleEndian.PutUint16(b[len(b)-4:], uint16(idx))
+	for _, t := range ms.table {
+		b = append(append(b, t...), 0)
+	}
+	return append(b, ms.value...), true
+}
+
+// channel returns the value of logical channel i (after the RX map)
+func (m *MockFC) channel(i int) uint16 {
+	switch {
+	case m.p.otherrx: // centred sticks, AUX low but not off
+		if i < 4 {
+			return 1500
+		}
+		return 1200
+	case i >= 4:
+		return m.rc[i]
+	}
+	v := m.rc[m.p.fcmap[i]]
+	if lo, hi := int(m.p.rxrange[0]), int(m.p.rxrange[1]); hi > lo {
+		s := (int(v)-lo)*1000/(hi-lo) + 1000
+		if s < 750 {
+			s = 750
+		} else if s > 2250 {
+			s = 2250
+		}
+		v = uint16(s)
+	}
+	return v
+}
+
+func (m *MockFC) range_active(r ModeRange) bool {
+	ch := int(r.chanidx) + 4
+	if ch >= len(m.rc) {
+		return false
+	}
+	v := m.channel(ch)
+	return v >= make_pwm(r.start) && v < make_pwm(r.end)
+}
+
+func (m *MockFC) mode_active(permid byte) bool {
+	for _, r := range m.p.ranges {
+		if r.boxid == permid && m.range_active(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// link state; the caller holds m.mu
+func (m *MockFC) link(now time.Time) (failsafe bool, rclink bool) {
+	if now.Sub(m.lastrc) > mock_LINK_TIMEOUT {
+		return true, false
+	}
+	good := now.Sub(m.linkup)
+	return good < mock_FS_RECOVERY, good >= mock_RCLINK_STABLE
+}
+
+// arming flags; the caller holds m.mu
+func (m *MockFC) armflags(now time.Time) uint32 {
+	var flags uint32
+	if m.armed {
+		flags |= armflag_ARMED
+	}
+	if m.ever {
+		flags |= armflag_EVER_ARMED
+	}
+	if m.armed {
+		return flags
+	}
+	if _, rclink := m.link(now); !rclink {
+		flags |= armflag_RC_LINK
+	}
+	if m.channel(3) > mock_MIN_CHECK {
+		flags |= armflag_THROTTLE
+	}
+	if m.p.navunsafe && !(m.p.bypass() && m.channel(2) > mock_BYPASS_YAW) {
+		flags |= armflag_NAV_UNSAFE
+	}
+	if !m.swoff {
+		flags |= armflag_ARM_SWITCH
+	}
+	return flags
+}
+
+func (m *MockFC) set_rc(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastrc) > mock_LINK_TIMEOUT {
+		m.linkup = now
+	}
+	m.lastrc = now
+	for i := 0; i < len(m.rc) && i*2+1 < len(data); i++ {
+		m.rc[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+
+	armsw := m.mode_active(PERM_ARM)
+	if !armsw {
+		m.swoff = true
+		m.armed = false
+		return
+	}
+	if !m.armed {
+		if m.armflags(now)&^0x7f == 0 {
+			m.armed = true
+			m.ever = true
+		} else {
+			m.swoff = false // must be toggled off again
+		}
+	}
+}
+
+func (m *MockFC) boxflags(now time.Time) uint64 {
+	var bits uint64
+	failsafe, _ := m.link(now)
+	for i, b := range m.p.boxes {
+		on := false
+		switch b.permid {
+		case PERM_ARM:
+			on = m.armed
+		case PERM_FS:
+			on = failsafe || m.mode_active(PERM_FS)
+		case PERM_POSHOLD, PERM_RTH, PERM_WP, PERM_CRUISE, PERM_COURSE_HOLD:
+			on = !m.p.navunsafe && m.mode_active(b.permid) // need a position
+		default:
+			on = m.mode_active(b.permid)
+		}
+		if on {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+func (m *MockFC) status(cmd uint16) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	box := m.boxflags(now)
+	arm := m.armflags(now)
+	var b []byte
+	switch cmd {
+	case msp.INAV_STATUS:
+		b = make([]byte, 22)
+		binary.LittleEndian.PutUint16(b[0:], 1000) // cycle time
+		binary.LittleEndian.PutUint32(b[9:], arm)
+		binary.LittleEndian.PutUint64(b[13:], box)
+	case msp.STATUS_EX:
+		b = make([]byte, 16)
+		binary.LittleEndian.PutUint16(b[0:], 1000)
+		binary.LittleEndian.PutUint32(b[6:], uint32(box))
+		binary.LittleEndian.PutUint16(b[13:], uint16(arm))
+	default:
+		b = make([]byte, 11)
+		binary.LittleEndian.PutUint16(b[0:], 1000)
+		binary.LittleEndian.PutUint32(b[6:], uint32(box))
+	}
+	return b
+}
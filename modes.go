@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Flight mode selection. The AUX channel values for a set of modes come
+// from the solver (modesolve.go); activation is then verified from the
+// box flags in the FC status.
+
+const mode_VERIFY = 1500 * time.Millisecond // time allowed for the FC to report a new mode
+
+var mode_keys = []struct {
+	key    rune
+	permid byte
+}{
+	{'1', PERM_ANGLE}, {'2', PERM_HORIZON}, {'3', PERM_MANUAL}, {'4', PERM_ALTHOLD},
+	{'5', PERM_POSHOLD}, {'6', PERM_RTH}, {'7', PERM_WP}, {'8', PERM_CRUISE},
+	{'9', PERM_COURSE_HOLD}, {'0', PERM_LAUNCH},
+}
+
+func key_mode(key rune) (byte, bool) {
+	for _, k := range mode_keys {
+		if k.key == key {
+			return k.permid, true
+		}
+	}
+	return 0, false
+}
+
+// flight_mode is true for the modes that may be selected from the keys;
+// others (beeper, camera control, OSD layout ...) are not flight modes
+func flight_mode(permid byte) bool {
+	for _, k := range mode_keys {
+		if k.permid == permid {
+			return true
+		}
+	}
+	return false
+}
+
+// set_modes selects the flight modes, to be sent by serialise_rx
+func (m *MSPSerial) set_modes(modes []byte) error {
+	vals, err := m.solve_modes(modes)
+	if err != nil {
+		return err
+	}
+	m.cmodes = append([]byte{}, modes...)
+	m.clear_aux_overrides(vals)
+	m.amu.Lock()
+	m.auxvals = vals
+	m.amu.Unlock()
+	m.modet = time.Now()
+	m.modechk = false
+	return nil
+}
+
+// toggle_mode adds a mode to the current selection, or removes it
+func (m *MSPSerial) toggle_mode(permid byte) error {
+	var modes []byte
+	found := false
+	for _, id := range m.cmodes {
+		if id == permid {
+			found = true
+		} else {
+			modes = append(modes, id)
+		}
+	}
+	if !found {
+		modes = append(modes, permid)
+	}
+	return m.set_modes(modes)
+}
+
+// mode_mask is the box flag for a mode, 0 if the FC doesn't have it
+func (m *MSPSerial) mode_mask(permid byte) uint64 {
+	return m.boxes.Mask(permid)
+}
+
+// verify_mode checks the selected modes against the FC box flags,
+// logging once when they are confirmed, or not seen in time
+func (m *MSPSerial) verify_mode(boxflags uint64) {
+	if m.modechk || m.auxvals == nil {
+		return
+	}
+	var missing []string
+	for _, id := range m.cmodes {
+		if mask := m.mode_mask(id); mask == 0 || boxflags&mask == 0 {
+			missing = append(missing, m.mode_name(id))
+		}
+	}
+	switch {
+	case len(missing) == 0:
+		log.Printf("Mode %s active\n", m.mode_label())
+		m.modechk = true
+	case time.Since(m.modet) > mode_VERIFY:
+		log.Printf("Mode %s not reported by FC (Box: %s)\n", strings.Join(missing, "+"), m.format_box(boxflags))
+		m.modechk = true
+	}
+}
+
+func (m *MSPSerial) mode_label() string {
+	if len(m.cmodes) == 0 {
+		return "ACRO"
+	}
+	var names []string
+	for _, id := range m.cmodes {
+		names = append(names, m.mode_name(id))
+	}
+	return strings.Join(names, "+")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Mode combination solver. A mode is active if any of its ranges is
+// active, so for each AUX channel the distinct sets of modes that some
+// value turns on are found, then one set per channel is chosen such that
+// the union is exactly the wanted modes (of those that have ranges).
+// Mode range steps are 25us, so a channel has at most 48 distinct values.
+// Only flight modes (and any others wanted) are considered, and a channel
+// is only driven if its resting value (explicit or default) won't do, so
+// other switches, and those that rest on a flight mode channel, keep
+// their positions.
+
+const mode_STEPS = 48
+
+type mode_choice struct {
+	modes []byte // active at val, sorted
+	val   uint16
+	rest  bool // the channel's resting value, so not driven
+}
+
+type mode_set map[byte]bool
+
+func (m *MSPSerial) set_names(s mode_set) string {
+	var names []string
+	for id := range s {
+		names = append(names, m.mode_name(id))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// step_val is the middle of a 25us step
+func step_val(k int) uint16 {
+	return uint16(900 + 25*k + 12)
+}
+
+func (r ModeRange) active(v uint16) bool {
+	return v >= make_pwm(r.start) && v < make_pwm(r.end)
+}
+
+// channel_choices returns, for an AUX channel, the distinct sets of
+// active modes, each with the middle value of its widest run of steps
+func channel_choices(ranges []ModeRange) []mode_choice {
+	type run struct {
+		start, len int
+		best       int // start of the widest run
+		bestlen    int
+	}
+	runs := make(map[string]*run)
+	sets := make(map[string][]byte)
+	var order []string
+	prev := ""
+	for k := 0; k < mode_STEPS; k++ {
+		v := step_val(k)
+		var ids []byte
+		for _, r := range ranges {
+			if r.active(v) {
+				ids = append(ids, r.boxid)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		key := fmt.Sprint(ids)
+		rn, ok := runs[key]
+		if !ok {
+			rn = &run{}
+			runs[key] = rn
+			sets[key] = ids
+			order = append(order, key)
+		}
+		if key != prev {
+			rn.start, rn.len = k, 0
+		}
+		rn.len++
+		if rn.len > rn.bestlen {
+			rn.best, rn.bestlen = rn.start, rn.len
+		}
+		prev = key
+	}
+	var choices []mode_choice
+	for _, key := range order {
+		rn := runs[key]
+		choices = append(choices, mode_choice{modes: sets[key],
+			val: uint16(900 + 25*rn.best + 25*rn.bestlen/2)})
+	}
+	return choices
+}
+
+// solve_modes returns AUX channel values (by AUX index) that activate
+// exactly the wanted modes, for the channels that must be driven to do
+// so. The arm channel is not used; modes on it are left to the arming
+// logic.
+func (m *MSPSerial) solve_modes(want []byte) (map[byte]uint16, error) {
+	wanted := make(mode_set)
+	for _, id := range want {
+		wanted[id] = true
+	}
+	bychan := make(map[byte][]ModeRange)
+	present := make(mode_set)
+	for _, r := range m.mranges {
+		if 4+int8(r.chanidx) == m.armchan || 4+int(r.chanidx) >= m.nchan {
+			continue
+		}
+		if !flight_mode(r.boxid) && !wanted[r.boxid] {
+			continue
+		}
+		bychan[r.chanidx] = append(bychan[r.chanidx], r)
+		present[r.boxid] = true
+	}
+	for id := range wanted {
+		if !present[id] {
+			return nil, fmt.Errorf("no usable mode range for %s", m.mode_name(id))
+		}
+	}
+
+	// Per channel, the choices that turn on no unwanted mode
+	type channel struct {
+		idx     byte
+		choices []mode_choice
+	}
+	var chans []channel
+	forced := make(map[byte]mode_set) // wanted mode => unwanted modes it always brings
+	clean := make(mode_set)           // wanted modes with a value that brings none
+	for idx, rs := range bychan {
+		ch := channel{idx: idx}
+		rest := mode_choice{val: m.aux_rest(idx), rest: true}
+		for _, r := range rs {
+			if r.active(rest.val) {
+				rest.modes = append(rest.modes, r.boxid)
+			}
+		}
+		sort.Slice(rest.modes, func(i, j int) bool { return rest.modes[i] < rest.modes[j] })
+		for _, c := range append([]mode_choice{rest}, channel_choices(rs)...) {
+			if len(ch.choices) > 0 && ch.choices[0].rest && string(c.modes) == string(ch.choices[0].modes) {
+				continue // as at rest, no need to drive it
+			}
+			ok := true
+			extra := make(mode_set)
+			for _, id := range c.modes {
+				if !wanted[id] {
+					ok = false
+					extra[id] = true
+				}
+			}
+			if ok {
+				ch.choices = append(ch.choices, c)
+				for _, id := range c.modes {
+					clean[id] = true
+				}
+				continue
+			}
+			for _, id := range c.modes {
+				if wanted[id] {
+					if f, seen := forced[id]; !seen {
+						forced[id] = extra
+					} else {
+						for x := range f {
+							if !extra[x] {
+								delete(f, x)
+							}
+						}
+					}
+				}
+			}
+		}
+		if len(ch.choices) == 0 {
+			return nil, fmt.Errorf("channel %d: every value activates an unwanted mode", idx+5)
+		}
+		chans = append(chans, ch)
+	}
+	sort.Slice(chans, func(i, j int) bool { return chans[i].idx < chans[j].idx })
+
+	// avail[n] is the wanted modes that channels n... can still provide
+	avail := make([]mode_set, len(chans)+1)
+	avail[len(chans)] = make(mode_set)
+	for n := len(chans) - 1; n >= 0; n-- {
+		avail[n] = make(mode_set)
+		for id := range avail[n+1] {
+			avail[n][id] = true
+		}
+		for _, c := range chans[n].choices {
+			for _, id := range c.modes {
+				avail[n][id] = true
+			}
+		}
+	}
+
+	vals := make(map[byte]uint16)
+	var search func(n int, got mode_set) bool
+	search = func(n int, got mode_set) bool {
+		if n == len(chans) {
+			return len(got) == len(wanted)
+		}
+		for id := range wanted {
+			if !got[id] && !avail[n][id] {
+				return false
+			}
+		}
+		for _, c := range chans[n].choices {
+			next := make(mode_set)
+			for id := range got {
+				next[id] = true
+			}
+			for _, id := range c.modes {
+				next[id] = true
+			}
+			if search(n+1, next) {
+				if !c.rest {
+					vals[chans[n].idx] = c.val
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if search(0, make(mode_set)) {
+		return vals, nil
+	}
+
+	var why []string
+	for id := range wanted {
+		if f, ok := forced[id]; ok && len(f) > 0 && !clean[id] {
+			why = append(why, fmt.Sprintf("%s always activates %s", m.mode_name(id), m.set_names(f)))
+		}
+	}
+	sort.Strings(why)
+	msg := fmt.Sprintf("%s not possible with the current mode ranges", m.set_names(wanted))
+	if len(why) > 0 {
+		msg += " (" + strings.Join(why, "; ") + ")"
+	}
+	return nil, fmt.Errorf("%s", msg)
+}
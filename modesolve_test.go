@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// solver_fc is an FC with the README example's mode ranges, ARM on channel 10
+func solver_fc() *MSPSerial {
+	m := &MSPSerial{armchan: 9, armval: 1800, nchan: 18}
+	var names []string
+	var ids []byte
+	for _, b := range inav7_boxes {
+		names = append(names, b.name)
+		ids = append(ids, b.permid)
+	}
+	m.set_boxes(strings.Join(names, ";")+";", ids)
+	m.mranges = append([]ModeRange{}, inav7_ranges...)
+	return m
+}
+
+// active_modes is the modes the AUX values turn on (other channels at
+// the default), less those on the arm channel
+func active_modes(m *MSPSerial, vals map[byte]uint16) []byte {
+	on := make(map[byte]bool)
+	for _, r := range m.mranges {
+		if 4+int8(r.chanidx) == m.armchan {
+			continue
+		}
+		v, ok := vals[r.chanidx]
+		if !ok {
+			v = aux_DEFAULT
+		}
+		if r.active(v) {
+			on[r.boxid] = true
+		}
+	}
+	var ids []byte
+	for id := range on {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestSolveModes(t *testing.T) {
+	tests := []struct {
+		name string
+		want []byte
+		err  string // part of the error, "" for solvable
+	}{
+		{"none", nil, ""},
+		{"poshold", []byte{PERM_POSHOLD}, ""},
+		{"rth", []byte{PERM_RTH}, ""},
+		{"wp", []byte{PERM_WP}, ""},
+		{"manual", []byte{PERM_MANUAL}, ""},
+		{"launch", []byte{PERM_LAUNCH}, ""},
+		{"althold and course hold", []byte{PERM_ALTHOLD, PERM_COURSE_HOLD}, ""},
+		{"wp, poshold and manual", []byte{PERM_WP, PERM_POSHOLD, PERM_MANUAL}, ""},
+		{"poshold and rth", []byte{PERM_POSHOLD, PERM_RTH}, "not possible"},
+		{"althold alone", []byte{PERM_ALTHOLD}, "NAV ALTHOLD always activates NAV COURSE HOLD"},
+		{"angle", []byte{PERM_ANGLE}, "no usable mode range for ANGLE"},
+		{"arm", []byte{PERM_ARM}, "no usable mode range for ARM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := solver_fc()
+			vals, err := m.solve_modes(tt.want)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with \"%s\"", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]byte{}, tt.want...)
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+			if got := active_modes(m, vals); string(got) != string(want) {
+				t.Errorf("values %v activate %v, want %v", vals, got, want)
+			}
+			if _, ok := vals[5]; ok {
+				t.Errorf("the arm channel was used: %v", vals)
+			}
+		})
+	}
+}
+
+func TestSolveModesChannels(t *testing.T) {
+	// A mode beyond the FC's channels isn't usable
+	m := solver_fc()
+	m.mranges = append(m.mranges, ModeRange{PERM_ANGLE, 16, 32, 48})
+	if _, err := m.solve_modes([]byte{PERM_ANGLE}); err == nil {
+		t.Error("ANGLE on channel 21 of 18: no error")
+	}
+	m.nchan = 34
+	if vals, err := m.solve_modes([]byte{PERM_ANGLE}); err != nil || vals[16] < 1700 {
+		t.Errorf("ANGLE on channel 21 of 34: %v, %v", vals, err)
+	}
+
+	// ALTHOLD on AUX1 high or AUX2 low, POSHOLD on AUX2 high: ALTHOLD
+	// alone could come from AUX2, but with POSHOLD it must be AUX1
+	m = solver_fc()
+	m.mranges = []ModeRange{{PERM_ALTHOLD, 0, 32, 48}, {PERM_ALTHOLD, 1, 0, 24}, {PERM_POSHOLD, 1, 24, 48}}
+	want := []byte{PERM_ALTHOLD, PERM_POSHOLD}
+	if vals, err := m.solve_modes(want); err != nil {
+		t.Errorf("ALTHOLD and POSHOLD: %v", err)
+	} else if got := active_modes(m, vals); string(got) != string(want) {
+		t.Errorf("ALTHOLD and POSHOLD: values %v activate %v", vals, got)
+	}
+
+	// A channel where every value activates an unwanted mode
+	m = solver_fc()
+	m.mranges = append(m.mranges, ModeRange{PERM_ANGLE, 9, 0, 48})
+	if _, err := m.solve_modes(nil); err == nil || !strings.Contains(err.Error(), "channel 14") {
+		t.Errorf("always on ANGLE: got %v", err)
+	}
+}
+
+func TestChannelChoices(t *testing.T) {
+	// POSHOLD 1300-1700, RTH 1700-2100: off, POSHOLD, RTH, each at the
+	// middle of its run
+	c := channel_choices(inav7_ranges[:2])
+	if len(c) != 3 {
+		t.Fatalf("%d choices: %v", len(c), c)
+	}
+	for i, want := range []struct {
+		modes []byte
+		val   uint16
+	}{{nil, 1100}, {[]byte{PERM_POSHOLD}, 1500}, {[]byte{PERM_RTH}, 1900}} {
+		if string(c[i].modes) != string(want.modes) || c[i].val != want.val {
+			t.Errorf("choice %d: %v at %d, want %v at %d", i, c[i].modes, c[i].val, want.modes, want.val)
+		}
+	}
+}
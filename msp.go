@@ -2,29 +2,33 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"sort"
-	"strings"
+	"sync"
+	"time"
 
-	"go.bug.st/serial"
+	"github.com/TByte007/msp_control/msp"
 )
 
 const (
-	PERM_ARM     = 0
-	PERM_MANUAL  = 12
-	PERM_HORIZON = 2
-	PERM_ANGLE   = 1
-	PERM_LAUNCH  = 36
-	PERM_RTH     = 10
-	PERM_WP      = 28
-	PERM_CRUISE  = 45
-	PERM_ALTHOLD = 3
-	PERM_POSHOLD = 11
-	PERM_FS      = 27
+	PERM_ARM         = 0
+	PERM_MANUAL      = 12
+	PERM_HORIZON     = 2
+	PERM_ANGLE       = 1
+	PERM_LAUNCH      = 36
+	PERM_RTH         = 10
+	PERM_WP          = 28
+	PERM_CRUISE      = 53
+	PERM_COURSE_HOLD = 45
+	PERM_ALTHOLD     = 3
+	PERM_POSHOLD     = 11
+	PERM_FS          = 27
 )
 
 const (
@@ -35,54 +39,84 @@ const (
 	PHASE_Disarming
 )
 
+// INAV arming flags; those above 0x7f prevent arming
 const (
-	msp_API_VERSION = 1
-	msp_FC_VARIANT  = 2
-	msp_FC_VERSION  = 3
-	msp_BOARD_INFO  = 4
-	msp_BUILD_INFO  = 5
-
-	msp_NAME        = 10
-	msp_MODE_RANGES = 34
-	msp_STATUS      = 101
-	msp_SET_RAW_RC  = 200
-	msp_RC          = 105
-	msp_STATUS_EX   = 150
-	msp_RX_MAP      = 64
-	msp_BOXNAMES    = 116
-
-	msp_COMMON_SETTING = 0x1003
-	msp2_INAV_STATUS   = 0x2000
-	rx_START           = 1400
-	rx_RAND            = 200
+	armflag_ARMED      = 1 << 2
+	armflag_EVER_ARMED = 1 << 3
+	armflag_NAV_UNSAFE = 1 << 11
+	armflag_ARM_SWITCH = 1 << 14
+	armflag_RC_LINK    = 1 << 18
+	armflag_THROTTLE   = 1 << 19
 )
+
+const bypass_YAW = 2000 // full yaw, for the nav_extra_arming_safety bypass
+
+// Arm channel values, other than the ARM range's
+const (
+	arm_OFF    = 1001 // disarmed, a little clue as to the arm channel
+	arm_DISARM = 999
+)
+
 const (
-	state_INIT = iota
-	state_M
-	state_DIRN
-	state_LEN
-	state_CMD
-	state_DATA
-	state_CRC
-
-	state_X_HEADER2
-	state_X_FLAGS
-	state_X_ID1
-	state_X_ID2
-	state_X_LEN1
-	state_X_LEN2
-	state_X_DATA
-	state_X_CHECKSUM
+	rx_START = 1400
+	rx_RAND  = 200
+)
+
+const (
+	rc_CHANNELS     = 16 // if the FC doesn't answer MSP_RC; all INAV accept this many
+	rc_MIN_CHANNELS = 5  // AETR + 1 AUX
 )
 
 const SETTING_STR string = "nav_extra_arming_safety"
 const MAX_MODE_ACTIVATION_CONDITION_COUNT int = 40
 
+const msp_TRANSPORT_FAIL = 0xffff
+
+const init_TIMEOUT = 500 * time.Millisecond
+
+// FC capabilities, as found by MSPInit
+type Caps uint32
+
+const (
+	CAP_MSPV2          Caps = 1 << iota // API 2.x, MSPv2 framing
+	CAP_COMMON_SETTING                  // MSP2_COMMON_SETTING
+	CAP_SETTING_INFO                    // MSP2_COMMON_SETTING_INFO
+	CAP_STATUS_EX                       // MSP_STATUS_EX
+	CAP_INAV_STATUS                     // MSP2_INAV_STATUS
+)
+
+func (c Caps) Has(x Caps) bool {
+	return c&x == x
+}
+
 type SChan struct {
-	len  uint16
-	cmd  uint16
-	ok   bool
-	data []byte
+	len    uint16
+	cmd    uint16
+	ok     bool
+	crcerr bool
+	data   []byte
+}
+
+// MSPError is returned by Transact when the FC answers with an error
+// ('!') frame, typically for a command it does not support.
+type MSPError struct {
+	Cmd uint16
+}
+
+func (e *MSPError) Error() string {
+	return fmt.Sprintf("MSP %d (%x) rejected by FC", e.Cmd, e.Cmd)
+}
+
+var (
+	ErrTimeout   = errors.New("MSP timeout")
+	ErrCRC       = errors.New("MSP CRC error")
+	ErrTransport = errors.New("MSP transport closed")
+)
+
+// A pending Transact, waiting for a reply to cmd
+type mspwaiter struct {
+	cmd uint16
+	c   chan SChan
 }
 
 type SerDev interface {
@@ -100,258 +134,142 @@ type ModeRange struct {
 
 type MSPSerial struct {
 	klass     int
+	dd        DevDescription
+	capture   *capwriter
 	sd        SerDev
 	usev2     bool
 	bypass    bool
-	vcapi     uint16
-	fcvers    uint32
+	caps      Caps
+	Info      FCInfo
 	a         int8
 	e         int8
 	r         int8
 	t         int8
 	c0        chan SChan
+	enc       *msp.Encoder
 	armchan   int8
 	armval    uint16
 	angchan   int8
-	angval    uint16
 	arm_mask  uint64
-	cmode     int // Current mode
+	nchan     int             // RC channels, from the MSP_RC reply
+	cmodes    []byte          // Current modes
+	auxvals   map[byte]uint16 // AUX channel values for cmodes, by AUX index
+	amu       sync.Mutex      // protects auxset, auxdef and auxvals
+	auxset    map[byte]uint16 // explicit AUX values, by AUX index
+	auxdef    map[byte]uint16 // resting AUX values, by AUX index
+	modet     time.Time       // when cmodes was selected
+	modechk   bool            // cmodes verified (or reported as not active)
+	pred      mode_predict
+	rch       rc_health
 	mranges   []ModeRange
 	fail_mask uint64
-	boxparts  []string
-}
-
-var nchan = int(18)
-
-func crc8_dvb_s2(crc byte, a byte) byte {
-	crc ^= a
-	for i := 0; i < 8; i++ {
-		if (crc & 0x80) != 0 {
-			crc = (crc << 1) ^ 0xd5
-		} else {
-			crc = crc << 1
-		}
-	}
-	return crc
-}
-
-func encode_msp2(cmd uint16, payload []byte) []byte {
-	var paylen int16
-	if len(payload) > 0 {
-		paylen = int16(len(payload))
-	}
-	buf := make([]byte, 9+paylen)
-	buf[0] = '$'
-	buf[1] = 'X'
-	buf[2] = '<'
-	buf[3] = 0 // flags
-	binary.LittleEndian.PutUint16(buf[4:6], cmd)
-	binary.LittleEndian.PutUint16(buf[6:8], uint16(paylen))
-	if paylen > 0 {
-		copy(buf[8:], payload)
-	}
-	crc := byte(0)
-	for _, b := range buf[3 : paylen+8] {
-		crc = crc8_dvb_s2(crc, b)
-	}
-	buf[8+paylen] = crc
-	return buf
-}
-
-func encode_msp(cmd uint16, payload []byte) []byte {
-	var paylen byte
-	if len(payload) > 0 {
-		paylen = byte(len(payload))
-	}
-	buf := make([]byte, 6+paylen)
-	buf[0] = '$'
-	buf[1] = 'M'
-	buf[2] = '<'
-	buf[3] = paylen
-	buf[4] = byte(cmd)
-	if paylen > 0 {
-		copy(buf[5:], payload)
-	}
-	crc := byte(0)
-	for _, b := range buf[3:] {
-		crc ^= b
-	}
-	buf[5+paylen] = crc
-	return buf
+	boxes     BoxMap
+	retries   int
+	wmu       sync.Mutex // serialises writes
+	mu        sync.Mutex // protects waiters, closed, bridged, routes, rejected
+	waiters   []*mspwaiter
+	closed    bool
+	bridged   bool
+	routes    []msp_route
+	rejected  map[uint16]bool
+	rdone     chan struct{} // closed when the reader exits
 }
 
 func (m *MSPSerial) Read_msp(c0 chan SChan) {
-	inp := make([]byte, 1024)
-	var sc SChan
-	var count = uint16(0)
-	var crc = byte(0)
-
-	n := state_INIT
-
+	sd := m.sd // m.sd may be replaced on reconnection
+	dec := msp.NewDecoder(sd)
 	for {
-		nb, err := m.sd.Read(inp)
-		if err == nil && nb > 0 {
-			for i := 0; i < nb; i++ {
-				switch n {
-				case state_INIT:
-					if inp[i] == '$' {
-						n = state_M
-						sc.ok = false
-						sc.len = 0
-						sc.cmd = 0
-					}
-				case state_M:
-					if inp[i] == 'M' {
-						n = state_DIRN
-					} else if inp[i] == 'X' {
-						n = state_X_HEADER2
-					} else {
-						n = state_INIT
-					}
-				case state_DIRN:
-					if inp[i] == '!' {
-						n = state_LEN
-					} else if inp[i] == '>' {
-						n = state_LEN
-						sc.ok = true
-					} else {
-						n = state_INIT
-					}
-
-				case state_X_HEADER2:
-					if inp[i] == '!' {
-						n = state_X_FLAGS
-					} else if inp[i] == '>' {
-						n = state_X_FLAGS
-						sc.ok = true
-					} else {
-						n = state_INIT
-					}
-
-				case state_X_FLAGS:
-					crc = crc8_dvb_s2(0, inp[i])
-					n = state_X_ID1
-
-				case state_X_ID1:
-					crc = crc8_dvb_s2(crc, inp[i])
-					sc.cmd = uint16(inp[i])
-					n = state_X_ID2
-
-				case state_X_ID2:
-					crc = crc8_dvb_s2(crc, inp[i])
-					sc.cmd |= (uint16(inp[i]) << 8)
-					n = state_X_LEN1
-
-				case state_X_LEN1:
-					crc = crc8_dvb_s2(crc, inp[i])
-					sc.len = uint16(inp[i])
-					n = state_X_LEN2
-
-				case state_X_LEN2:
-					crc = crc8_dvb_s2(crc, inp[i])
-					sc.len |= (uint16(inp[i]) << 8)
-					if sc.len > 0 {
-						n = state_X_DATA
-						count = 0
-						sc.data = make([]byte, sc.len)
-					} else {
-						n = state_X_CHECKSUM
-					}
-				case state_X_DATA:
-					crc = crc8_dvb_s2(crc, inp[i])
-					sc.data[count] = inp[i]
-					count++
-					if count == sc.len {
-						n = state_X_CHECKSUM
-					}
-
-				case state_X_CHECKSUM:
-					ccrc := inp[i]
-					if crc != ccrc {
-						fmt.Fprintf(os.Stderr, "CRC error on %d\n", sc.cmd)
-					} else {
-						c0 <- sc
-					}
-					n = state_INIT
-
-				case state_LEN:
-					sc.len = uint16(inp[i])
-					crc = inp[i]
-					n = state_CMD
-				case state_CMD:
-					sc.cmd = uint16(inp[i])
-					crc ^= inp[i]
-					if sc.len == 0 {
-						n = state_CRC
-					} else {
-						sc.data = make([]byte, sc.len)
-						n = state_DATA
-						count = 0
-					}
-				case state_DATA:
-					sc.data[count] = inp[i]
-					crc ^= inp[i]
-					count++
-					if count == sc.len {
-						n = state_CRC
-					}
-				case state_CRC:
-					ccrc := inp[i]
-					if crc != ccrc {
-						fmt.Fprintf(os.Stderr, "CRC error on %d\n", sc.cmd)
-					} else {
-						//						fmt.Fprintf(os.Stderr, "Cmd %v Len %v\n", sc.cmd, sc.len)
-						c0 <- sc
-					}
-					n = state_INIT
-				}
+		f, err := dec.Decode()
+		var cerr *msp.CRCError
+		if err == nil {
+			if f.Dirn == msp.ToFC {
+				continue // our own request, echoed by the link
 			}
+			m.dispatch(c0, SChan{len: uint16(len(f.Payload)), cmd: f.Cmd, ok: !f.IsError(), data: f.Payload})
+		} else if errors.As(err, &cerr) {
+			log.Printf("CRC error on %d\n", cerr.Cmd)
+			m.dispatch(c0, SChan{cmd: cerr.Cmd, crcerr: true})
 		} else {
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Read %v\n", err)
+			if err != io.EOF {
+				log.Printf("Read %v\n", err)
 			} else {
-				fmt.Fprintln(os.Stderr, "serial EOF")
+				log.Println("serial EOF")
 			}
-
-			sc.ok = false
-			sc.len = 0
-			sc.cmd = 0xffff
-			c0 <- sc
-			m.sd.Close()
+			sd.Close()
+			m.dispatch(c0, SChan{cmd: msp_TRANSPORT_FAIL})
 			break
 		}
 	}
 }
 
-func NewMSPSerial(dd DevDescription) *MSPSerial {
-	m := MSPSerial{armchan: -1, klass: dd.klass}
+// start_reader runs Read_msp on the current device; rdone is closed
+// when it exits
+func (m *MSPSerial) start_reader() {
+	done := make(chan struct{})
+	m.rdone = done
+	go func() {
+		m.Read_msp(m.c0)
+		close(done)
+	}()
+}
+
+// open_device opens the transport described by dd. An auto-detected
+// baud rate is saved in dd so it need not be detected again.
+func open_device(dd *DevDescription) (SerDev, error) {
 	switch dd.klass {
-	case DevClass_SERIAL:
-		p, err := serial.Open(dd.name, &serial.Mode{BaudRate: dd.param})
+	case DevClass_SERIAL, DevClass_USB:
+		name := dd.name
+		if dd.klass == DevClass_USB {
+			var err error
+			if name, err = find_usb_port(dd.name); err != nil {
+				return nil, err
+			}
+		}
+		p, baud, err := open_serial(name, dd.param)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		m.sd = p
-		return &m
+		dd.param = baud
+		return p, nil
 	case DevClass_BT:
-		bt := NewBT(dd.name)
-		m.sd = bt
-		return &m
+		bt, err := NewBT(dd.name)
+		if err != nil {
+			return nil, err
+		}
+		return bt, nil
 	case DevClass_TCP:
-		var conn net.Conn
-		remote := fmt.Sprintf("%s:%d", dd.name, dd.param)
-		addr, err := net.ResolveTCPAddr("tcp", remote)
-		if err == nil {
-			conn, err = net.DialTCP("tcp", nil, addr)
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", dd.name, dd.param), dd.timeout)
+		if err != nil {
+			return nil, err
 		}
+		return conn, nil
+	case DevClass_TCPLISTEN:
+		t, err := NewTCPListen(fmt.Sprintf("%s:%d", dd.name, dd.param), dd.timeout)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		return t, nil
+	case DevClass_RFC2217:
+		r, err := NewRFC2217(dd.name, dd.param, dd.param1, dd.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case DevClass_MOCK:
+		mfc, err := NewMockFC(dd.name)
+		if err != nil {
+			return nil, err
 		}
-		m.sd = conn
-		return &m
+		return mfc, nil
+	case DevClass_REPLAY:
+		r, err := NewReplay(dd.name)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
 	case DevClass_UDP:
 		var laddr, raddr *net.UDPAddr
-		var conn net.Conn
+		var conn *net.UDPConn
 		var err error
 		if dd.param1 != 0 {
 			raddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", dd.name1, dd.param1))
@@ -369,161 +287,338 @@ func NewMSPSerial(dd DevDescription) *MSPSerial {
 			conn, err = net.DialUDP("udp", laddr, raddr)
 		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		m.sd = conn
-		return &m
+		return conn, nil
 	default:
-		fmt.Fprintln(os.Stderr, "Unsupported device")
-		os.Exit(1)
+		return nil, errors.New("Unsupported device")
 	}
-	return nil
+}
+
+func NewMSPSerial(dd DevDescription) *MSPSerial {
+	sd, err := open_device(&dd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := &MSPSerial{armchan: -1, angchan: -1, nchan: rc_CHANNELS, klass: dd.klass, retries: 2, dd: dd}
+	m.Info.Channels = rc_CHANNELS
+	if dd.capture != "" {
+		if m.capture, err = NewCapture(dd.capture); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Capturing to %s\n", dd.capture)
+	}
+	m.attach(sd)
+	return m
+}
+
+func (m *MSPSerial) attach(sd SerDev) {
+	if m.capture != nil {
+		sd = &CaptureDev{sd: sd, cw: m.capture}
+	}
+	m.sd = sd
+	m.enc = msp.NewEncoder(sd)
+	m.enc.Tunnel = m.dd.tunnel
 }
 
 func (m *MSPSerial) Send_msp(cmd uint16, payload []byte) {
-	var buf []byte
-	if m.usev2 || cmd > 255 {
-		buf = encode_msp2(cmd, payload)
-	} else {
-		buf = encode_msp(cmd, payload)
+	m.wmu.Lock()
+	m.add_route(cmd, 0, nil)
+	m.enc.V2 = m.usev2 && !m.enc.Tunnel
+	m.enc.Encode(msp.Frame{Cmd: cmd, Payload: payload})
+	m.wmu.Unlock()
+}
+
+// dispatch hands a decoded frame to the bridge client that requested
+// it, else the oldest Transact waiting for that command; anything else
+// is unsolicited and goes to c0.
+// Unsolicited frames are dropped if the subscriber is not keeping up,
+// so a stalled reader cannot block transactions.
+func (m *MSPSerial) dispatch(c0 chan SChan, sc SChan) {
+	m.mu.Lock()
+	if sc.cmd == msp_TRANSPORT_FAIL {
+		ws := m.waiters
+		m.waiters = nil
+		m.closed = true
+		m.routes = nil
+		m.mu.Unlock()
+		for _, w := range ws {
+			w.c <- sc
+		}
+		c0 <- sc
+		return
+	}
+	if r, ok := m.take_route(sc.cmd); ok && r.client != nil {
+		m.mu.Unlock()
+		if !sc.crcerr {
+			r.client.reply(r.vers, sc)
+		}
+		return
+	}
+	for i, w := range m.waiters {
+		if w.cmd == sc.cmd {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			m.mu.Unlock()
+			w.c <- sc
+			return
+		}
+	}
+	m.mu.Unlock()
+	if sc.crcerr {
+		return
+	}
+	select {
+	case c0 <- sc:
+	default:
+		log.Printf("Unsolicited %d dropped\n", sc.cmd)
+	}
+}
+
+func (m *MSPSerial) remove_waiter(w *mspwaiter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, x := range m.waiters {
+		if x == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			break
+		}
+	}
+}
+
+// reject records that the FC answered cmd with an error, returning true
+// the first time
+func (m *MSPSerial) reject(cmd uint16) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejected == nil {
+		m.rejected = make(map[uint16]bool)
+	}
+	if m.rejected[cmd] {
+		return false
+	}
+	m.rejected[cmd] = true
+	return true
+}
+
+func (m *MSPSerial) is_rejected(cmd uint16) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rejected[cmd]
+}
+
+// Transact sends cmd and waits up to timeout for the matching reply,
+// retrying (m.retries times) on timeout or CRC error. An FC error
+// reply is returned as *MSPError.
+func (m *MSPSerial) Transact(cmd uint16, payload []byte, timeout time.Duration) (SChan, error) {
+	err := ErrTimeout
+	for try := 0; try <= m.retries; try++ {
+		w := &mspwaiter{cmd: cmd, c: make(chan SChan, 1)}
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return SChan{}, ErrTransport
+		}
+		m.waiters = append(m.waiters, w)
+		m.mu.Unlock()
+
+		m.Send_msp(cmd, payload)
+		select {
+		case v := <-w.c:
+			switch {
+			case v.cmd == msp_TRANSPORT_FAIL:
+				return v, ErrTransport
+			case v.crcerr:
+				err = ErrCRC
+			case !v.ok:
+				m.reject(cmd)
+				return v, &MSPError{Cmd: cmd}
+			default:
+				return v, nil
+			}
+		case <-time.After(timeout):
+			m.remove_waiter(w)
+			err = ErrTimeout
+		}
+	}
+	return SChan{}, err
+}
+
+// probe is a Transact for MSPInit; a rejected or unanswered command is
+// reported as !ok, a lost link is fatal
+func (m *MSPSerial) probe(cmd uint16, payload []byte) (SChan, bool) {
+	v, err := m.Transact(cmd, payload, init_TIMEOUT)
+	if err != nil {
+		var merr *MSPError
+		if errors.Is(err, ErrTransport) {
+			log.Fatalln("MSPInit: link lost")
+		} else if !errors.As(err, &merr) {
+			fmt.Fprintf(os.Stderr, "MSP %d: %v\n", cmd, err)
+		}
+		return v, false
 	}
-	m.sd.Write(buf)
+	return v, true
 }
 
 func MSPInit(dd DevDescription) *MSPSerial {
-	var fw, api, vers, board, gitrev string
 	var v6 bool
 
 	m := NewMSPSerial(dd)
-	m.c0 = make(chan SChan)
-	m.cmode = PERM_ANGLE // Set default mode
-
-	go m.Read_msp(m.c0)
-
-	m.Send_msp(msp_API_VERSION, nil)
-	for done := false; !done; {
-		//		select {
-		//		case v := <-m.c0:
-		v := <-m.c0
-		switch v.cmd {
-		case msp_API_VERSION:
-			if v.len > 2 {
-				api = fmt.Sprintf("%d.%d", v.data[1], v.data[2])
-				m.vcapi = uint16(v.data[1])<<8 | uint16(v.data[2])
-				m.usev2 = (v.data[1] == 2)
-				m.Send_msp(msp_FC_VARIANT, nil)
-			}
-		case msp_FC_VARIANT:
-			fw = string(v.data[0:4])
-			m.Send_msp(msp_FC_VERSION, nil)
-		case msp_FC_VERSION:
-			vers = fmt.Sprintf("%d.%d.%d", v.data[0], v.data[1], v.data[2])
-			m.fcvers = uint32(v.data[0])<<16 | uint32(v.data[1])<<8 | uint32(v.data[2])
-			m.Send_msp(msp_BUILD_INFO, nil)
-			v6 = (v.data[0] >= 6)
-			if v.data[0] == 1 {
-				nchan = 16
-			}
-		case msp_BUILD_INFO:
-			gitrev = string(v.data[19:])
-			m.Send_msp(msp_BOARD_INFO, nil)
-		case msp_BOARD_INFO:
-			if v.len > 8 {
-				board = string(v.data[9:])
-			} else {
-				board = string(v.data[0:4])
-			}
-			fmt.Fprintf(os.Stderr, "%s v%s %s (%s) API %s\n", fw, vers, board, gitrev, api)
-			if m.usev2 {
-				lstr := len(SETTING_STR)
-				buf := make([]byte, lstr+1)
-				copy(buf, SETTING_STR)
-				buf[lstr] = 0
-				m.Send_msp(msp_COMMON_SETTING, buf)
-			} else {
-				m.Send_msp(msp_RX_MAP, nil)
-			}
+	m.Info.ArmingSafety = -1
+	m.c0 = make(chan SChan, 32)
+	m.cmodes = []byte{PERM_ANGLE}   // Set default mode
+	m.set_rxmap([]byte{0, 1, 3, 2}) // AETR unless the FC says otherwise
 
-		case msp_COMMON_SETTING:
-			if v.len > 0 {
-				bystr := v.data[0]
-				if v6 {
-					bystr++
-				}
-				if bystr == 2 {
-					m.bypass = true
-				}
-				fmt.Printf("%s: %d (bypass %v)\n", SETTING_STR, bystr, m.bypass)
-			}
-			m.Send_msp(msp_RX_MAP, nil)
-
-		case msp_RX_MAP:
-			if v.len == 4 {
-				m.a = int8(v.data[0]) * 2
-				m.e = int8(v.data[1]) * 2
-				m.r = int8(v.data[2]) * 2
-				m.t = int8(v.data[3]) * 2
-				var cmap [4]byte
-				cmap[v.data[0]] = 'A'
-				cmap[v.data[1]] = 'E'
-				cmap[v.data[2]] = 'R'
-				cmap[v.data[3]] = 'T'
-				fmt.Fprintf(os.Stderr, "map: %s\n", cmap)
-			}
-			m.Send_msp(msp_NAME, nil)
-		case msp_NAME:
-			if v.len > 0 {
-				fmt.Fprintf(os.Stderr, "name: \"%s\"\n", v.data[:v.len])
-			}
-			m.Send_msp(msp_BOXNAMES, nil)
-		case msp_BOXNAMES:
-			if v.len > 0 {
-				fmt.Fprintf(os.Stderr, "box: %s\n", v.data[:v.len])
-				m.setup_box_masks(string(v.data))
-			} else {
-				fmt.Fprintln(os.Stderr, "No Boxen")
-			}
-			m.Send_msp(msp_MODE_RANGES, nil)
+	m.start_reader()
+
+	v, ok := m.probe(msp.API_VERSION, nil)
+	if !ok || v.len < 3 {
+		log.Fatalln("No MSP response from FC")
+	}
+	m.Info.API = fmt.Sprintf("%d.%d", v.data[1], v.data[2])
+	m.set_api(v.data)
 
-		case msp_MODE_RANGES:
-			if v.len > 0 {
-				m.deserialise_modes(v.data)
+	if v, ok = m.probe(msp.FC_VARIANT, nil); ok && v.len >= 4 {
+		m.Info.Variant = string(v.data[0:4])
+	}
+	if v, ok = m.probe(msp.FC_VERSION, nil); ok && v.len >= 3 {
+		m.Info.Version = fmt.Sprintf("%d.%d.%d", v.data[0], v.data[1], v.data[2])
+		v6 = (v.data[0] >= 6)
+	}
+	if v, ok = m.probe(msp.BUILD_INFO, nil); ok {
+		m.Info.set_build(v.data)
+	}
+	if v, ok = m.probe(msp.BOARD_INFO, nil); ok {
+		m.Info.set_board(v.data)
+	}
+	board := m.Info.Target
+	if board == "" {
+		board = m.Info.Board
+	}
+	fmt.Fprintf(os.Stderr, "%s v%s %s (%s) API %s\n", m.Info.Variant, m.Info.Version, board, m.Info.GitRev, m.Info.API)
+
+	if m.caps.Has(CAP_MSPV2) {
+		if raw, bystr := m.arming_safety(v6); bystr >= 0 {
+			m.bypass = (bystr == 2)
+			m.Info.ArmingSafety = raw
+			m.Info.ArmingSafetyName = arming_safety_name(bystr)
+			m.Info.Bypass = m.bypass
+			fmt.Fprintf(os.Stderr, "%s: %d (bypass %v)\n", SETTING_STR, bystr, m.bypass)
+		}
+		m.probe_settings()
+	}
+
+	if v, ok = m.probe(msp.RX_MAP, nil); ok && v.len == 4 {
+		m.Info.RxMap = m.set_rxmap(v.data)
+		fmt.Fprintf(os.Stderr, "map: %s\n", m.Info.RxMap)
+	} else {
+		m.Info.RxMap = "AETR"
+		fmt.Fprintln(os.Stderr, "map: AETR (assumed)")
+	}
+	if v, ok = m.probe(msp.RC, nil); ok && m.set_nchan(v.data) {
+		fmt.Fprintf(os.Stderr, "channels: %d\n", m.nchan)
+	} else {
+		fmt.Fprintf(os.Stderr, "channels: %d (assumed)\n", m.nchan)
+	}
+	if v, ok = m.probe(msp.NAME, nil); ok {
+		if v.len > 0 {
+			m.Info.Name = string(v.data[:v.len])
+			fmt.Fprintf(os.Stderr, "name: \"%s\"\n", m.Info.Name)
+		}
+	}
+	if v, ok = m.probe(msp.BOXNAMES, nil); ok && v.len > 0 {
+		fmt.Fprintf(os.Stderr, "box: %s\n", v.data[:v.len])
+		names := string(v.data[:v.len])
+		var ids []byte
+		if v, ok = m.probe(msp.BOXIDS, nil); ok {
+			ids = v.data[:v.len]
+		}
+		m.set_boxes(names, ids)
+		if !m.boxes.HasIDs() {
+			fmt.Fprintln(os.Stderr, "No box ids, mode selection unavailable")
+		}
+		m.Info.Boxes = m.boxes.Names()
+	} else {
+		fmt.Fprintln(os.Stderr, "No Boxen")
+	}
+	if v, ok = m.probe(msp.MODE_RANGES, nil); ok && v.len > 0 {
+		m.deserialise_modes(v.data)
+	}
+	m.set_info_ranges()
+
+	// Probe for the most capable status command
+	for _, cmd := range status_cmds {
+		if cmd > 255 && !m.caps.Has(CAP_MSPV2) {
+			continue
+		}
+		if _, ok = m.probe(cmd, nil); ok {
+			switch cmd {
+			case msp.INAV_STATUS:
+				m.caps |= CAP_INAV_STATUS
+			case msp.STATUS_EX:
+				m.caps |= CAP_STATUS_EX
 			}
-			done = true
-		default:
-			fmt.Fprintf(os.Stderr, "Unsolicited %d, length %d\n", v.cmd, v.len)
+			break
 		}
 	}
 	return m
 }
 
-func (m *MSPSerial) setup_box_masks(boxen string) {
-	m.boxparts = strings.Split(boxen, ";")
-	for i, b := range m.boxparts {
-		switch b {
-		case "ARM":
-			m.arm_mask = 1 << i
-		case "FAILSAFE":
-			m.fail_mask = 1 << i
-		default:
-		}
+func (m *MSPSerial) set_api(data []byte) {
+	m.usev2 = (data[1] == 2)
+	if m.usev2 {
+		m.caps |= CAP_MSPV2
 	}
 }
 
-func (m *MSPSerial) format_box(bval uint64) string {
-	var sb strings.Builder
-	for i, b := range m.boxparts {
-		j := uint64(1 << i)
-		if (bval & j) != 0 {
-			sb.WriteString(b)
-			sb.WriteByte(',')
-		}
+// set_nchan sets the channel count from the MSP_RC reply (the FC's
+// channel count for the current receiver), false if implausible
+func (m *MSPSerial) set_nchan(data []byte) bool {
+	n := len(data) / 2
+	if n < rc_MIN_CHANNELS {
+		return false
 	}
-	if sb.Len() == 0 {
-		return ""
-	} else {
-		return sb.String()[0 : sb.Len()-1]
+	m.nchan = n
+	m.Info.Channels = n
+	return true
+}
+
+// set_rxmap sets the AETR byte offsets, returning the map as a string
+func (m *MSPSerial) set_rxmap(data []byte) string {
+	m.a = int8(data[0]) * 2
+	m.e = int8(data[1]) * 2
+	m.r = int8(data[2]) * 2
+	m.t = int8(data[3]) * 2
+	var cmap [4]byte
+	cmap[data[0]] = 'A'
+	cmap[data[1]] = 'E'
+	cmap[data[2]] = 'R'
+	cmap[data[3]] = 'T'
+	return string(cmap[:])
+}
+
+// set_boxes builds the box map and the ARM / FAILSAFE masks; without
+// MSP_BOXIDS (ids nil), the masks are found by name
+func (m *MSPSerial) set_boxes(names string, ids []byte) {
+	m.boxes = NewBoxMap(names, ids)
+	if m.boxes.HasIDs() {
+		m.arm_mask = m.boxes.Mask(PERM_ARM)
+		m.fail_mask = m.boxes.Mask(PERM_FS)
+		return
 	}
+	if i, ok := m.boxes.ByName("ARM"); ok {
+		m.arm_mask = 1 << i
+	}
+	if i, ok := m.boxes.ByName("FAILSAFE"); ok {
+		m.fail_mask = 1 << i
+	}
+}
+
+func (m *MSPSerial) format_box(bval uint64) string {
+	return m.boxes.Format(bval)
+}
+
+func (m *MSPSerial) mode_name(id byte) string {
+	return m.boxes.Name(id)
 }
 
 /*
@@ -542,9 +637,9 @@ func (m *MSPSerial) deserialise_modes(buf []byte) {
 			break
 		}
 		if buf[i+3] != 0 {
-			invalid := (buf[0] == PERM_ARM && (buf[i+3]-buf[i+2]) > 40) // 40 * 25us = 1000us
-			if !invalid {
-				m.mranges = append(m.mranges, ModeRange{buf[i], buf[i+1], buf[i+2], buf[i+3]})
+			r := ModeRange{buf[i], buf[i+1], buf[i+2], buf[i+3]}
+			if r.boxid != PERM_ARM || !arm_unusable(r) {
+				m.mranges = append(m.mranges, r)
 			}
 		}
 		i += 4
@@ -557,15 +652,16 @@ func (m *MSPSerial) deserialise_modes(buf []byte) {
 	})
 
 	for _, r := range m.mranges {
-		dump_mode(r)
+		m.dump_mode(r)
 		switch r.boxid {
 		case PERM_ARM:
+			if int(r.chanidx)+4 >= m.nchan { // not a channel we send
+				continue
+			}
 			m.armchan = 4 + int8(r.chanidx)
 			m.armval = uint16(r.end+r.start)*25/2 + 900
 		case PERM_ANGLE:
 			m.angchan = 4 + int8(r.chanidx)
-			m.angval = uint16(r.end+r.start)*25/2 + 900
-
 		}
 	}
 }
@@ -574,32 +670,26 @@ func (m *MSPSerial) deserialise_modes(buf []byte) {
 //	setthr int, roll int, pitch int, yaw int,
 //	fs bool) []byte {
 
-func (m *MSPSerial) serialise_rx(phase int, vrc vRCset) []byte {
+func (m *MSPSerial) serialise_rx(phase int, vrc vRCset) ([]byte, error) {
 
-	buf := make([]byte, nchan*2)
-	armoff, angoff := int(0), int(0)
+	buf := make([]byte, m.nchan*2)
+	armoff := int(0)
 
 	var ae = m.a + 2
 	var ee = m.e + 2
 	var re = m.r + 2
 	var te = m.t + 2
 
-	for i := 4; i < nchan; i++ {
-		binary.LittleEndian.PutUint16(buf[i*2:2+i*2], uint16(1000))
+	for i := 4; i < m.nchan; i++ {
+		binary.LittleEndian.PutUint16(buf[i*2:2+i*2], m.aux_value(byte(i-4)))
 	}
 
 	if m.armchan != -1 {
 		armoff = int(m.armchan) * 2
-		binary.LittleEndian.PutUint16(buf[armoff:armoff+2], uint16(1001)) // a little clue as to the arm channel
-	}
-	switch m.cmode {
-	case PERM_ANGLE:
-		if m.angchan != -1 {
-			angoff = int(m.angchan) * 2
-			binary.LittleEndian.PutUint16(buf[angoff:angoff+2], m.angval) // a little clue as to the ang channel
+		if armoff+2 > len(buf) {
+			return nil, fmt.Errorf("arm channel %d beyond the %d channels sent", m.armchan+1, m.nchan)
 		}
-	case PERM_HORIZON:
-	case PERM_RTH:
+		binary.LittleEndian.PutUint16(buf[armoff:armoff+2], uint16(arm_OFF))
 	}
 
 	baseval := uint16(1500)
@@ -624,6 +714,9 @@ func (m *MSPSerial) serialise_rx(phase int, vrc vRCset) []byte {
 		if m.armchan != -1 {
 			binary.LittleEndian.PutUint16(buf[armoff:armoff+2], uint16(m.armval))
 		}
+		if vrc.bypass { // vrc.yaw is kept, for once armed
+			binary.LittleEndian.PutUint16(buf[m.r:re], uint16(bypass_YAW))
+		}
 		binary.LittleEndian.PutUint16(buf[m.t:te], uint16(1000))
 	case PHASE_LowThrottle:
 		thr := uint16(0)
@@ -640,16 +733,18 @@ func (m *MSPSerial) serialise_rx(phase int, vrc vRCset) []byte {
 		binary.LittleEndian.PutUint16(buf[m.a:ae], baseval)
 		binary.LittleEndian.PutUint16(buf[m.e:ee], baseval)
 		binary.LittleEndian.PutUint16(buf[m.r:re], baseval)
-		binary.LittleEndian.PutUint16(buf[armoff:armoff+2], uint16(999))
+		if m.armchan != -1 {
+			binary.LittleEndian.PutUint16(buf[armoff:armoff+2], uint16(arm_DISARM))
+		}
 		binary.LittleEndian.PutUint16(buf[m.t:te], uint16(1000))
 	}
-	return buf
+	return buf, nil
 }
 
-func deserialise_rx(b []byte) []int16 {
+func (m *MSPSerial) deserialise_rx(b []byte) []int16 {
 	bl := binary.Size(b) / 2
-	if bl > nchan {
-		bl = nchan
+	if bl > m.nchan {
+		bl = m.nchan
 	}
 	buf := make([]int16, bl)
 	for j := 0; j < bl; j++ {
@@ -0,0 +1,225 @@
+package msp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	state_INIT = iota
+	state_M
+	state_DIRN
+	state_LEN
+	state_CMD
+	state_JUMBO_LEN1
+	state_JUMBO_LEN2
+	state_DATA
+	state_CRC
+
+	state_X_HEADER2
+	state_X_FLAGS
+	state_X_ID1
+	state_X_ID2
+	state_X_LEN1
+	state_X_LEN2
+	state_X_DATA
+	state_X_CHECKSUM
+)
+
+// Decoder is a streaming MSP v1/v2 parser. Bytes that are not part of a
+// frame are skipped. MSPv1 jumbo frames are accepted, and MSPv2 frames
+// tunnelled in MSPv1 are unwrapped and returned with Version V2inV1.
+type Decoder struct {
+	r     io.Reader
+	inp   []byte
+	nb    int
+	pos   int
+	state int
+	f     Frame
+	plen  uint16
+	count uint16
+	crc   byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, inp: make([]byte, 1024)}
+}
+
+// Decode returns the next complete frame. A checksum failure is returned as
+// *CRCError and decoding may continue; any other error comes from the
+// underlying reader (a zero length read is reported as io.EOF).
+func (d *Decoder) Decode() (Frame, error) {
+	for {
+		if d.pos == d.nb {
+			nb, err := d.r.Read(d.inp)
+			if err != nil {
+				return Frame{}, err
+			}
+			if nb == 0 {
+				return Frame{}, io.EOF
+			}
+			d.nb = nb
+			d.pos = 0
+		}
+		for d.pos < d.nb {
+			c := d.inp[d.pos]
+			d.pos++
+			if done, err := d.step(c); done {
+				return d.f, err
+			}
+		}
+	}
+}
+
+// step advances the state machine by one byte, reporting when a frame (or
+// CRC failure) is complete.
+func (d *Decoder) step(c byte) (bool, error) {
+	switch d.state {
+	case state_INIT:
+		if c == '$' {
+			d.state = state_M
+			d.f = Frame{}
+			d.plen = 0
+		}
+	case state_M:
+		if c == 'M' {
+			d.f.Version = V1
+			d.state = state_DIRN
+		} else if c == 'X' {
+			d.f.Version = V2
+			d.state = state_X_HEADER2
+		} else {
+			d.state = state_INIT
+		}
+	case state_DIRN:
+		if c == Error || c == FromFC || c == ToFC {
+			d.f.Dirn = c
+			d.state = state_LEN
+		} else {
+			d.state = state_INIT
+		}
+
+	case state_X_HEADER2:
+		if c == Error || c == FromFC || c == ToFC {
+			d.f.Dirn = c
+			d.state = state_X_FLAGS
+		} else {
+			d.state = state_INIT
+		}
+
+	case state_X_FLAGS:
+		d.crc = crc8_dvb_s2(0, c)
+		d.f.Flags = c
+		d.state = state_X_ID1
+
+	case state_X_ID1:
+		d.crc = crc8_dvb_s2(d.crc, c)
+		d.f.Cmd = uint16(c)
+		d.state = state_X_ID2
+
+	case state_X_ID2:
+		d.crc = crc8_dvb_s2(d.crc, c)
+		d.f.Cmd |= (uint16(c) << 8)
+		d.state = state_X_LEN1
+
+	case state_X_LEN1:
+		d.crc = crc8_dvb_s2(d.crc, c)
+		d.plen = uint16(c)
+		d.state = state_X_LEN2
+
+	case state_X_LEN2:
+		d.crc = crc8_dvb_s2(d.crc, c)
+		d.plen |= (uint16(c) << 8)
+		if d.plen > 0 {
+			d.state = state_X_DATA
+			d.count = 0
+			d.f.Payload = make([]byte, d.plen)
+		} else {
+			d.state = state_X_CHECKSUM
+		}
+	case state_X_DATA:
+		d.crc = crc8_dvb_s2(d.crc, c)
+		d.f.Payload[d.count] = c
+		d.count++
+		if d.count == d.plen {
+			d.state = state_X_CHECKSUM
+		}
+
+	case state_X_CHECKSUM:
+		d.state = state_INIT
+		if d.crc != c {
+			return true, &CRCError{Cmd: d.f.Cmd}
+		}
+		return true, nil
+
+	case state_LEN:
+		d.plen = uint16(c)
+		d.crc = c
+		d.state = state_CMD
+	case state_CMD:
+		d.f.Cmd = uint16(c)
+		d.crc ^= c
+		if d.plen == JUMBO_FRAME_SIZE {
+			d.state = state_JUMBO_LEN1
+		} else {
+			d.start_v1_data()
+		}
+	case state_JUMBO_LEN1:
+		d.crc ^= c
+		d.plen = uint16(c)
+		d.state = state_JUMBO_LEN2
+	case state_JUMBO_LEN2:
+		d.crc ^= c
+		d.plen |= (uint16(c) << 8)
+		d.start_v1_data()
+	case state_DATA:
+		d.f.Payload[d.count] = c
+		d.crc ^= c
+		d.count++
+		if d.count == d.plen {
+			d.state = state_CRC
+		}
+	case state_CRC:
+		d.state = state_INIT
+		if d.crc != c {
+			return true, &CRCError{Cmd: d.f.Cmd}
+		}
+		if d.f.Cmd == V2_FRAME_ID && len(d.f.Payload) >= 6 {
+			return true, d.unwrap_v2()
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (d *Decoder) start_v1_data() {
+	if d.plen == 0 {
+		d.state = state_CRC
+	} else {
+		d.f.Payload = make([]byte, d.plen)
+		d.state = state_DATA
+		d.count = 0
+	}
+}
+
+// unwrap_v2 replaces the current (v1, cmd 255) frame with the MSPv2 frame
+// it carries: flags, cmd16, len16, payload, crc8.
+func (d *Decoder) unwrap_v2() error {
+	b := d.f.Payload
+	plen := int(binary.LittleEndian.Uint16(b[3:5]))
+	if 5+plen+1 > len(b) {
+		return &CRCError{Cmd: V2_FRAME_ID}
+	}
+	crc := byte(0)
+	for _, x := range b[:5+plen] {
+		crc = crc8_dvb_s2(crc, x)
+	}
+	d.f.Version = V2inV1
+	d.f.Flags = b[0]
+	d.f.Cmd = binary.LittleEndian.Uint16(b[1:3])
+	d.f.Payload = b[5 : 5+plen]
+	if crc != b[5+plen] {
+		return &CRCError{Cmd: d.f.Cmd}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package msp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+type Encoder struct {
+	w io.Writer
+	// Use MSPv2 framing for all commands, not just those > 255
+	V2 bool
+	// Send MSPv2 frames tunnelled in MSPv1, for links that only pass v1
+	Tunnel bool
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes f as a single Write. If f.Version is unset, the framing is
+// chosen from the command ID and the encoder's V2 setting; if f.Dirn is
+// unset, the frame is a request ('<').
+func (e *Encoder) Encode(f Frame) error {
+	if f.Version == 0 {
+		if e.V2 || f.Cmd > 255 {
+			f.Version = V2
+		} else {
+			f.Version = V1
+		}
+	}
+	if f.Version == V2 && e.Tunnel {
+		f.Version = V2inV1
+	}
+	_, err := e.w.Write(Encode(f))
+	return err
+}
+
+// Encode returns the wire representation of f
+func Encode(f Frame) []byte {
+	if f.Dirn == 0 {
+		f.Dirn = ToFC
+	}
+	switch f.Version {
+	case V2:
+		return encode_msp2(f)
+	case V2inV1:
+		// the v2 frame, less its "$X<" header, is the v1 payload
+		inner := encode_msp2(f)[3:]
+		return encode_msp(Frame{Dirn: f.Dirn, Cmd: V2_FRAME_ID, Payload: inner})
+	default:
+		return encode_msp(f)
+	}
+}
+
+func encode_msp2(f Frame) []byte {
+	paylen := len(f.Payload)
+	buf := make([]byte, 9+paylen)
+	buf[0] = '$'
+	buf[1] = 'X'
+	buf[2] = f.Dirn
+	buf[3] = f.Flags
+	binary.LittleEndian.PutUint16(buf[4:6], f.Cmd)
+	binary.LittleEndian.PutUint16(buf[6:8], uint16(paylen))
+	copy(buf[8:], f.Payload)
+	crc := byte(0)
+	for _, b := range buf[3 : paylen+8] {
+		crc = crc8_dvb_s2(crc, b)
+	}
+	buf[8+paylen] = crc
+	return buf
+}
+
+// MSPv1, using the jumbo form for payloads of 255 bytes or more
+func encode_msp(f Frame) []byte {
+	paylen := len(f.Payload)
+	hdrlen := 5
+	if paylen >= JUMBO_FRAME_SIZE {
+		hdrlen = 7
+	}
+	buf := make([]byte, hdrlen+paylen+1)
+	buf[0] = '$'
+	buf[1] = 'M'
+	buf[2] = f.Dirn
+	if hdrlen == 7 {
+		buf[3] = JUMBO_FRAME_SIZE
+		binary.LittleEndian.PutUint16(buf[5:7], uint16(paylen))
+	} else {
+		buf[3] = byte(paylen)
+	}
+	buf[4] = byte(f.Cmd)
+	copy(buf[hdrlen:], f.Payload)
+	crc := byte(0)
+	for _, b := range buf[3 : hdrlen+paylen] {
+		crc ^= b
+	}
+	buf[hdrlen+paylen] = crc
+	return buf
+}
@@ -0,0 +1,96 @@
+// Package msp implements the MultiWii Serial Protocol (MSP v1 and v2)
+// framing as used by INAV and related flight controllers.
+//
+// A Decoder reads Frames from an io.Reader (serial port, socket, ...) and an
+// Encoder writes them to an io.Writer. The package only deals with framing;
+// interpreting payloads is left to the caller.
+package msp
+
+import (
+	"fmt"
+)
+
+// Command IDs
+const (
+	API_VERSION = 1
+	FC_VARIANT  = 2
+	FC_VERSION  = 3
+	BOARD_INFO  = 4
+	BUILD_INFO  = 5
+
+	NAME           = 10
+	MODE_RANGES    = 34
+	SET_MODE_RANGE = 35
+	RX_MAP         = 64
+	STATUS         = 101
+	RC             = 105
+	BOXNAMES       = 116
+	BOXIDS         = 119
+	STATUS_EX      = 150
+	SET_RAW_RC     = 200
+	EEPROM_WRITE   = 250
+
+	// MSPv2 only
+	COMMON_SETTING      = 0x1003
+	COMMON_SET_SETTING  = 0x1004
+	COMMON_SETTING_INFO = 0x1007
+	INAV_STATUS         = 0x2000
+)
+
+type Version byte
+
+const (
+	V1     Version = 1
+	V2     Version = 2
+	V2inV1 Version = 3 // MSPv2 frame tunnelled in an MSPv1 frame
+)
+
+const (
+	// MSPv1 command ID carrying a tunnelled MSPv2 frame
+	V2_FRAME_ID = 255
+	// MSPv1 length byte marking a jumbo frame (16-bit length follows)
+	JUMBO_FRAME_SIZE = 255
+)
+
+// Direction, the third byte of the frame header
+const (
+	ToFC   = '<'
+	FromFC = '>'
+	Error  = '!'
+)
+
+type Frame struct {
+	Version Version
+	Dirn    byte
+	Flags   byte // MSPv2 only
+	Cmd     uint16
+	Payload []byte
+}
+
+// IsError reports whether the frame is an error ('!') reply, i.e. the FC
+// rejected or did not recognise the command.
+func (f Frame) IsError() bool {
+	return f.Dirn == Error
+}
+
+// CRCError is returned by Decoder.Decode for a frame that failed its
+// checksum. The decoder resynchronises on the next frame.
+type CRCError struct {
+	Cmd uint16
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("CRC error on %d", e.Cmd)
+}
+
+func crc8_dvb_s2(crc byte, a byte) byte {
+	crc ^= a
+	for i := 0; i < 8; i++ {
+		if (crc & 0x80) != 0 {
+			crc = (crc << 1) ^ 0xd5
+		} else {
+			crc = crc << 1
+		}
+	}
+	return crc
+}
@@ -0,0 +1,147 @@
+package msp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestEncodeV1(t *testing.T) {
+	got := Encode(Frame{Version: V1, Cmd: API_VERSION})
+	want := []byte{'$', 'M', '<', 0, API_VERSION, API_VERSION}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestEncodeJumbo(t *testing.T) {
+	for _, n := range []int{254, 255, 300} {
+		b := Encode(Frame{Version: V1, Dirn: FromFC, Cmd: BOXNAMES, Payload: payload(n)})
+		if n < JUMBO_FRAME_SIZE {
+			if b[3] != byte(n) || len(b) != 6+n {
+				t.Errorf("%d bytes: header % x, length %d", n, b[:5], len(b))
+			}
+			continue
+		}
+		if b[3] != JUMBO_FRAME_SIZE || int(b[5])|int(b[6])<<8 != n || len(b) != 8+n {
+			t.Errorf("%d bytes: jumbo header % x, length %d", n, b[:7], len(b))
+		}
+	}
+}
+
+func TestEncodeTunnel(t *testing.T) {
+	f := Frame{Cmd: INAV_STATUS, Payload: payload(4)}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.Tunnel = true
+	if err := e.Encode(f); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if string(b[:3]) != "$M<" || b[4] != V2_FRAME_ID {
+		t.Fatalf("not a v1 tunnel frame: % x", b)
+	}
+	inner := Encode(Frame{Version: V2, Cmd: INAV_STATUS, Payload: payload(4)})[3:]
+	if int(b[3]) != len(inner) || !bytes.Equal(b[5:5+len(inner)], inner) {
+		t.Errorf("v1 payload % x, want the v2 frame % x", b[5:len(b)-1], inner)
+	}
+
+	// v1 commands aren't tunnelled
+	buf.Reset()
+	e.Encode(Frame{Cmd: RC})
+	if b := buf.Bytes(); string(b[:3]) != "$M<" || b[4] != RC {
+		t.Errorf("v1 command: % x", b)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Version: V1, Dirn: FromFC, Cmd: NAME, Payload: []byte("BENCHYMCTESTY")},
+		{Version: V1, Dirn: FromFC, Cmd: MODE_RANGES},
+		{Version: V1, Dirn: FromFC, Cmd: BOXNAMES, Payload: payload(300)},
+		{Version: V1, Dirn: Error, Cmd: STATUS_EX},
+		{Version: V2, Dirn: FromFC, Cmd: COMMON_SETTING, Payload: payload(3)},
+		{Version: V2, Dirn: FromFC, Cmd: INAV_STATUS, Payload: payload(1000)},
+		{Version: V2inV1, Dirn: FromFC, Flags: 1, Cmd: INAV_STATUS, Payload: payload(20)},
+		{Version: V2inV1, Dirn: FromFC, Cmd: COMMON_SETTING_INFO, Payload: payload(400)},
+	}
+	var wire []byte
+	for _, f := range frames {
+		wire = append(wire, "noise"...)
+		wire = append(wire, Encode(f)...)
+	}
+	for _, name := range []string{"whole", "bytewise"} {
+		var r io.Reader = bytes.NewReader(wire)
+		if name == "bytewise" {
+			r = iotest.OneByteReader(r)
+		}
+		d := NewDecoder(r)
+		for i, want := range frames {
+			got, err := d.Decode()
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", name, i, err)
+			}
+			if got.Version != want.Version || got.Dirn != want.Dirn || got.Flags != want.Flags ||
+				got.Cmd != want.Cmd || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("%s: frame %d: got %v/%c/%d/%d (%d bytes), want %v/%c/%d/%d (%d bytes)", name, i,
+					got.Version, got.Dirn, got.Flags, got.Cmd, len(got.Payload),
+					want.Version, want.Dirn, want.Flags, want.Cmd, len(want.Payload))
+			}
+			if got.IsError() != (want.Dirn == Error) {
+				t.Errorf("%s: frame %d: IsError %v", name, i, got.IsError())
+			}
+		}
+		if _, err := d.Decode(); err != io.EOF {
+			t.Errorf("%s: at end, got %v, want EOF", name, err)
+		}
+	}
+}
+
+func TestCRCError(t *testing.T) {
+	for _, f := range []Frame{
+		{Version: V1, Dirn: FromFC, Cmd: RC, Payload: payload(8)},
+		{Version: V1, Dirn: FromFC, Cmd: RC, Payload: payload(260)},
+		{Version: V2, Dirn: FromFC, Cmd: INAV_STATUS, Payload: payload(8)},
+		{Version: V2inV1, Dirn: FromFC, Cmd: INAV_STATUS, Payload: payload(8)},
+	} {
+		bad := Encode(f)
+		bad[len(bad)-2] ^= 0x55 // the last payload byte
+		good := Encode(Frame{Version: V1, Dirn: FromFC, Cmd: NAME, Payload: []byte("ok")})
+		d := NewDecoder(bytes.NewReader(append(bad, good...)))
+
+		_, err := d.Decode()
+		var cerr *CRCError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("%v %d: got %v, want a CRC error", f.Version, len(f.Payload), err)
+		}
+		// the tunnel's own checksum fails first, so the error is for the v1 frame
+		if want := f.Cmd; f.Version != V2inV1 && cerr.Cmd != want {
+			t.Errorf("%v: CRC error on %d, want %d", f.Version, cerr.Cmd, want)
+		}
+		// and the decoder carries on with the next frame
+		if next, err := d.Decode(); err != nil || next.Cmd != NAME {
+			t.Errorf("%v: after the CRC error got %d, %v", f.Version, next.Cmd, err)
+		}
+	}
+}
+
+func TestTunnelInnerCRC(t *testing.T) {
+	inner := encode_msp2(Frame{Dirn: FromFC, Cmd: INAV_STATUS, Payload: payload(8)})[3:]
+	inner[len(inner)-1] ^= 0x55
+	d := NewDecoder(bytes.NewReader(encode_msp(Frame{Dirn: FromFC, Cmd: V2_FRAME_ID, Payload: inner})))
+	_, err := d.Decode()
+	var cerr *CRCError
+	if !errors.As(err, &cerr) || cerr.Cmd != INAV_STATUS {
+		t.Errorf("got %v, want a CRC error on %d", err, INAV_STATUS)
+	}
+}
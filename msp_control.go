@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const log_prefix = "[msp_ctrl] "
@@ -19,27 +20,52 @@ const (
 	DevClass_TCP
 	DevClass_UDP
 	DevClass_BT
+	DevClass_USB
+	DevClass_TCPLISTEN
+	DevClass_RFC2217
+	DevClass_REPLAY
+	DevClass_MOCK
 )
 
 type DevDescription struct {
-	klass  int
-	name   string
-	param  int
-	name1  string
-	param1 int
+	klass   int
+	name    string
+	param   int
+	name1   string
+	param1  int
+	tunnel  bool
+	timeout time.Duration
+	capture string
 }
 
 var (
-	baud     = flag.Int("b", 115200, "Baud rate")
+	baud     = flag.Int("b", 115200, "Baud rate (0 to auto-detect)")
 	device   = flag.String("d", "", "Serial Device")
 	setthr   = flag.Int("throttle", -1, "Low throttle (µs)")
 	verbose  = flag.Bool("verbose", false, "log Rx/Tx stanzas")
 	auto_arm = flag.Bool("auto-arm", false, "Auto-arm FC when ready")
+	tunnel   = flag.Bool("tunnel", false, "Tunnel MSPv2 commands in MSPv1 frames (v1 only links)")
+	listdevs = flag.Bool("list-devices", false, "List serial devices and exit")
+	bridge   = flag.String("bridge", "", "Share the FC with MSP clients on this TCP address (e.g. :5770)")
+	capfile  = flag.String("capture", "", "Record all device traffic to this file")
+	giveup   = flag.Duration("reconnect", 0, "Reconnect for up to this long if the link drops (e.g. 30s, 0 to exit)")
+	jsonout  = flag.Bool("json", false, "JSON output for commands")
+	save     = flag.Bool("save", false, "Save settings to EEPROM after set")
+	auxtmpl  = flag.String("aux-template", "", "AUX defaults template file (per craft name)")
+	auxspec  = flag.String("aux", "", "AUX defaults, overriding the template (e.g. 9=2000,12=1500)")
+	plain    = flag.Bool("plain", false, "Plain log output, no dashboard")
 )
 
 func check_device() DevDescription {
 	devdesc := parse_device(*device)
-	if devdesc.name == "" {
+	if devdesc.name == "" && devdesc.klass == DevClass_NONE {
+		if name, err := find_usb_port(""); err == nil {
+			devdesc.klass = DevClass_SERIAL
+			devdesc.name = name
+			devdesc.param = *baud
+		}
+	}
+	if devdesc.name == "" && devdesc.klass == DevClass_NONE {
 		for _, v := range []string{"/dev/ttyACM0", "/dev/ttyUSB0"} {
 			if _, err := os.Stat(v); err == nil {
 				devdesc.klass = DevClass_SERIAL
@@ -49,11 +75,13 @@ func check_device() DevDescription {
 			}
 		}
 	}
-	if devdesc.name == "" && devdesc.param == 0 {
+	if devdesc.klass == DevClass_NONE {
 		log.Fatalln("No device given")
 	} else {
 		log.Printf("Using device %s\n", devdesc.name)
 	}
+	devdesc.tunnel = *tunnel
+	devdesc.capture = *capfile
 	return devdesc
 }
 
@@ -94,6 +122,18 @@ func splithost(uhost string) (string, int) {
 	return host, port
 }
 
+// "auto" (or 0) requests baud rate detection
+func parse_baud(s string) int {
+	if s == "auto" {
+		return 0
+	}
+	b, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Invalid baud rate \"%s\"\n", s)
+	}
+	return b
+}
+
 func parse_device(devstr string) DevDescription {
 	dd := DevDescription{name: "", klass: DevClass_NONE}
 	if devstr == "" {
@@ -103,9 +143,45 @@ func parse_device(devstr string) DevDescription {
 	if len(devstr) == 17 && (devstr)[2] == ':' && (devstr)[8] == ':' && (devstr)[14] == ':' {
 		dd.name = devstr
 		dd.klass = DevClass_BT
+	} else if strings.HasPrefix(devstr, "replay://") {
+		dd.klass = DevClass_REPLAY
+		dd.name = devstr[len("replay://"):]
+	} else if strings.HasPrefix(devstr, "mock://") {
+		dd.klass = DevClass_MOCK
+		dd.name = devstr[len("mock://"):]
+	} else if strings.HasPrefix(devstr, "usb:") {
+		// usb:selector[@baud], resolved to a port at open time
+		ss := strings.Split(devstr[4:], "@")
+		dd.klass = DevClass_USB
+		dd.name = ss[0]
+		if len(ss) > 1 {
+			dd.param = parse_baud(ss[1])
+		} else {
+			dd.param = *baud
+		}
+		if _, err := parse_usbsel(dd.name); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		u, err := url.Parse(devstr)
-		if err == nil {
+		if err == nil && u.Scheme == "tcp-listen" {
+			// tcp-listen://[host]:port[?timeout=duration]
+			dd.klass = DevClass_TCPLISTEN
+			dd.name, dd.param = splithost(u.Host)
+			if t := u.Query().Get("timeout"); t != "" {
+				if dd.timeout, err = time.ParseDuration(t); err != nil {
+					log.Fatalf("Invalid accept timeout \"%s\"\n", t)
+				}
+			}
+		} else if err == nil && u.Scheme == "rfc2217" {
+			// rfc2217://host:port[?baud=rate]
+			dd.klass = DevClass_RFC2217
+			dd.name, dd.param = splithost(u.Host)
+			dd.param1 = *baud
+			if b := u.Query().Get("baud"); b != "" {
+				dd.param1 = parse_baud(b)
+			}
+		} else if err == nil {
 			if u.Scheme == "tcp" {
 				dd.klass = DevClass_TCP
 			} else if u.Scheme == "udp" {
@@ -117,9 +193,9 @@ func parse_device(devstr string) DevDescription {
 				dd.klass = DevClass_SERIAL
 				dd.name = ss[0]
 				if len(ss) > 1 {
-					dd.param, _ = strconv.Atoi(ss[1])
+					dd.param = parse_baud(ss[1])
 				} else {
-					dd.param = 115200
+					dd.param = *baud
 				}
 			} else {
 				if u.RawQuery != "" {
@@ -154,17 +230,41 @@ func main() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of msp_control [options]\n")
+		fmt.Fprintf(os.Stderr, "Usage of msp_control [options] [command]\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  info\t\t\tFC identity (text, or JSON with -json)\n")
+		fmt.Fprintf(os.Stderr, "  get name ...\t\tShow settings\n")
+		fmt.Fprintf(os.Stderr, "  set name=value ...\tChange settings (-save to write EEPROM)\n")
+		fmt.Fprintf(os.Stderr, "  list [match]\t\tList settings (name containing match)\n")
 	}
 	flag.Parse()
 
+	if *listdevs {
+		list_devices()
+		return
+	}
+
 	devdesc := check_device()
 	s := MSPInit(devdesc)
-	if s.armchan == -1 || s.armval < 1000 {
+	if flag.NArg() > 0 {
+		if err := s.run_command(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if !s.arm_usable() && !s.fix_arm_range() {
 		log.Fatalln("Mis-configured arm switch --- see README")
 	} else {
 		fmt.Printf("Arming set for channel %d / %dus\n", s.armchan+1, s.armval)
-		s.main_rx_loop(*setthr, *verbose, *auto_arm)
+		if err := s.aux_defaults(*auxtmpl, *auxspec); err != nil {
+			log.Fatal(err)
+		}
+		if *bridge != "" {
+			if err := s.StartBridge(*bridge); err != nil {
+				log.Fatal(err)
+			}
+		}
+		s.main_rx_loop(*setthr, *verbose, *auto_arm, *giveup, *plain)
 	}
 }
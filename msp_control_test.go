@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type device_test struct {
+	dev  string
+	want DevDescription
+}
+
+func check_devices(t *testing.T, tests []device_test) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := parse_device(tt.dev); got != tt.want {
+			t.Errorf("\"%s\": got %+v, want %+v", tt.dev, got, tt.want)
+		}
+	}
+}
+
+func TestParseDevice(t *testing.T) {
+	check_devices(t, []device_test{
+		{"", DevDescription{klass: DevClass_NONE}},
+		{"/dev/ttyACM0", DevDescription{klass: DevClass_SERIAL, name: "/dev/ttyACM0", param: *baud}},
+		{"/dev/ttyUSB0@57600", DevDescription{klass: DevClass_SERIAL, name: "/dev/ttyUSB0", param: 57600}},
+		{"COM3", DevDescription{klass: DevClass_SERIAL, name: "COM3", param: *baud}},
+		{"tcp://localhost:5761", DevDescription{klass: DevClass_TCP, name: "localhost", param: 5761}},
+		{"tcp://[::1]:5761", DevDescription{klass: DevClass_TCP, name: "::1", param: 5761}},
+		{"udp://:14014", DevDescription{klass: DevClass_UDP, name: "", param: 14014}},
+		{"udp://remote:14015?bind=14014", DevDescription{klass: DevClass_UDP, param: 14014, name1: "remote", param1: 14015}},
+		{"udp://host:14015/local:14014", DevDescription{klass: DevClass_UDP, name: "host", param: 14015, name1: "local", param1: 14014}},
+		{"55:44:33:22:11:aa", DevDescription{klass: DevClass_BT, name: "55:44:33:22:11:aa"}},
+	})
+}
+
+func TestParseDeviceUSB(t *testing.T) {
+	check_devices(t, []device_test{
+		{"usb:", DevDescription{klass: DevClass_USB, param: *baud}},
+		{"usb:vid=0483,pid=5740", DevDescription{klass: DevClass_USB, name: "vid=0483,pid=5740", param: *baud}},
+		{"usb:vid=0483,pid=5740@57600", DevDescription{klass: DevClass_USB, name: "vid=0483,pid=5740", param: 57600}},
+		{"usb:product=SPEEDYBEE F405", DevDescription{klass: DevClass_USB, name: "product=SPEEDYBEE F405", param: *baud}},
+	})
+	for _, sel := range []string{"vid", "colour=red"} {
+		if _, err := parse_usbsel(sel); err == nil {
+			t.Errorf("selector \"%s\": no error", sel)
+		}
+	}
+}
+
+func TestParseDeviceBaud(t *testing.T) {
+	check_devices(t, []device_test{
+		{"/dev/ttyUSB0@auto", DevDescription{klass: DevClass_SERIAL, name: "/dev/ttyUSB0", param: 0}},
+		{"/dev/ttyUSB0@0", DevDescription{klass: DevClass_SERIAL, name: "/dev/ttyUSB0", param: 0}},
+		{"usb:@auto", DevDescription{klass: DevClass_USB, param: 0}},
+	})
+}
+
+func TestParseDeviceListen(t *testing.T) {
+	check_devices(t, []device_test{
+		{"tcp-listen://:5760", DevDescription{klass: DevClass_TCPLISTEN, param: 5760}},
+		{"tcp-listen://0.0.0.0:5760?timeout=30s", DevDescription{klass: DevClass_TCPLISTEN, name: "0.0.0.0", param: 5760, timeout: 30 * time.Second}},
+	})
+}
+
+func TestParseDeviceRFC2217(t *testing.T) {
+	check_devices(t, []device_test{
+		{"rfc2217://server:2217", DevDescription{klass: DevClass_RFC2217, name: "server", param: 2217, param1: *baud}},
+		{"rfc2217://server:2217?baud=57600", DevDescription{klass: DevClass_RFC2217, name: "server", param: 2217, param1: 57600}},
+	})
+}
+
+func TestParseDeviceReplay(t *testing.T) {
+	check_devices(t, []device_test{
+		{"replay://flight.cap", DevDescription{klass: DevClass_REPLAY, name: "flight.cap"}},
+		{"replay:///tmp/flight.cap", DevDescription{klass: DevClass_REPLAY, name: "/tmp/flight.cap"}},
+	})
+}
+
+func TestParseDeviceMock(t *testing.T) {
+	check_devices(t, []device_test{
+		{"mock://", DevDescription{klass: DevClass_MOCK}},
+		{"mock://nogps", DevDescription{klass: DevClass_MOCK, name: "nogps"}},
+	})
+}
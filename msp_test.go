@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// mock_init runs MSPInit against a mock FC profile
+func mock_init(t *testing.T, profile string) *MSPSerial {
+	t.Helper()
+	m := MSPInit(parse_device("mock://" + profile))
+	t.Cleanup(func() { m.sd.Close() })
+	return m
+}
+
+func TestMSPInit(t *testing.T) {
+	tests := []struct {
+		profile  string
+		version  string
+		nchan    int
+		armchan  int8
+		armval   uint16
+		safety   int
+		safename string
+		bypass   bool
+		caps     Caps
+	}{
+		{"inav7", "7.0.0", 18, 9, 1800, 1, "ALLOW_BYPASS", true, CAP_MSPV2 | CAP_INAV_STATUS | CAP_SETTING_INFO | CAP_COMMON_SETTING},
+		{"inav6", "6.1.1", 18, 9, 1800, 1, "ALLOW_BYPASS", true, CAP_MSPV2 | CAP_INAV_STATUS},
+		{"nobypass", "7.0.0", 18, 9, 1800, 0, "ON", false, CAP_MSPV2},
+		{"wide", "7.0.0", 34, 9, 1800, 1, "ALLOW_BYPASS", true, CAP_MSPV2},
+		{"legacy", "7.0.0", 18, 9, 1800, 1, "ALLOW_BYPASS", true, CAP_MSPV2 | CAP_STATUS_EX},
+		{"noarm", "7.0.0", 18, -1, 0, 1, "ALLOW_BYPASS", true, CAP_MSPV2},
+		{"badarm", "7.0.0", 18, -1, 0, 1, "ALLOW_BYPASS", true, CAP_MSPV2},
+		{"fararm", "7.0.0", 18, -1, 0, 1, "ALLOW_BYPASS", true, CAP_MSPV2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			m := mock_init(t, tt.profile)
+			if m.Info.Variant != "INAV" || m.Info.Version != tt.version || m.Info.Name != "BENCHYMCTESTY" {
+				t.Errorf("identity %s %s \"%s\"", m.Info.Variant, m.Info.Version, m.Info.Name)
+			}
+			if m.Info.RxMap != "AETR" {
+				t.Errorf("map %s", m.Info.RxMap)
+			}
+			if m.nchan != tt.nchan || m.Info.Channels != tt.nchan {
+				t.Errorf("channels %d / %d, want %d", m.nchan, m.Info.Channels, tt.nchan)
+			}
+			if m.armchan != tt.armchan || m.armval != tt.armval {
+				t.Errorf("arm channel %d / %dus, want %d / %dus", m.armchan, m.armval, tt.armchan, tt.armval)
+			}
+			if m.arm_usable() != (tt.armchan != -1) {
+				t.Errorf("arm_usable %v", m.arm_usable())
+			}
+			if m.Info.ArmingSafety != tt.safety || m.Info.ArmingSafetyName != tt.safename || m.bypass != tt.bypass {
+				t.Errorf("arming safety %d %s (bypass %v), want %d %s (bypass %v)", m.Info.ArmingSafety,
+					m.Info.ArmingSafetyName, m.bypass, tt.safety, tt.safename, tt.bypass)
+			}
+			if !m.caps.Has(tt.caps) {
+				t.Errorf("caps %x, want %x", m.caps, tt.caps)
+			}
+			if m.angchan != -1 {
+				t.Errorf("angle channel %d, the mock has no ANGLE range", m.angchan)
+			}
+		})
+	}
+}
+
+// echo_dev is a link that returns whatever is written to it
+type echo_dev struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (e *echo_dev) Read(buf []byte) (int, error)  { return e.r.Read(buf) }
+func (e *echo_dev) Write(buf []byte) (int, error) { return e.w.Write(buf) }
+func (e *echo_dev) Close() error {
+	e.w.Close()
+	return e.r.Close()
+}
+
+func TestEchoedRequest(t *testing.T) {
+	e := &echo_dev{}
+	e.r, e.w = io.Pipe()
+	m := &MSPSerial{armchan: -1, angchan: -1, nchan: rc_CHANNELS}
+	m.attach(e)
+	defer e.Close()
+	go m.Read_msp(make(chan SChan, 8))
+	if v, err := m.Transact(msp.API_VERSION, nil, 100*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("echoed request: got %+v %v, want a timeout", v, err)
+	}
+}
+
+func TestDeserialiseModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []ModeRange
+		nchan   int
+		nrange  int
+		armchan int8
+		armval  uint16
+	}{
+		{"inav7", inav7_ranges, 18, len(inav7_ranges), 9, 1800},
+		{"none", nil, 18, 0, -1, 0},
+		{"always on", []ModeRange{{PERM_ARM, 5, 0, 48}}, 18, 0, -1, 0},
+		{"on at 1001us", []ModeRange{{PERM_ARM, 5, 4, 20}}, 18, 0, -1, 0},
+		{"on at 999us", []ModeRange{{PERM_ARM, 5, 0, 4}}, 18, 0, -1, 0},
+		{"wide, off at 1001us", []ModeRange{{PERM_ARM, 5, 5, 48}}, 18, 1, 9, 1562},
+		{"beyond nchan", []ModeRange{{PERM_ARM, 16, 24, 48}}, 18, 1, -1, 0},
+		{"last channel", []ModeRange{{PERM_ARM, 13, 24, 48}}, 18, 1, 17, 1800},
+		{"angle", []ModeRange{{PERM_ANGLE, 2, 32, 48}, {PERM_ARM, 0, 32, 48}}, 18, 2, 4, 1900},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MSPSerial{armchan: -1, angchan: -1, nchan: tt.nchan}
+			var buf []byte
+			for _, r := range tt.ranges {
+				buf = append(buf, r.boxid, r.chanidx, r.start, r.end)
+			}
+			buf = append(buf, 0, 0, 0, 0) // an unused slot
+			m.deserialise_modes(buf)
+			if len(m.mranges) != tt.nrange {
+				t.Errorf("%d ranges, want %d", len(m.mranges), tt.nrange)
+			}
+			if m.armchan != tt.armchan || m.armval != tt.armval {
+				t.Errorf("arm channel %d / %dus, want %d / %dus", m.armchan, m.armval, tt.armchan, tt.armval)
+			}
+		})
+	}
+}
+
+// rx_chan returns channel i of an RC frame
+func rx_chan(m *MSPSerial, buf []byte, i int) int16 {
+	return m.deserialise_rx(buf)[i]
+}
+
+func TestSerialiseRx(t *testing.T) {
+	m := &MSPSerial{armchan: 9, armval: 1800, nchan: 18}
+	m.set_rxmap([]byte{0, 1, 3, 2}) // AETR
+	vrc := vRCset{roll: 100, pitch: -100, yaw: 50, thr: 1300}
+
+	tests := []struct {
+		phase         int
+		bypass        bool
+		yaw, thr, arm int16
+	}{
+		{PHASE_Unknown, false, 1550, 990, arm_OFF},
+		{PHASE_Quiescent, false, 1550, 1000, arm_OFF},
+		{PHASE_Arming, false, 1550, 1000, 1800},
+		{PHASE_Arming, true, bypass_YAW, 1000, 1800},
+		{PHASE_LowThrottle, false, 1550, 1300, 1800},
+		{PHASE_Disarming, false, 1500, 1000, arm_DISARM},
+	}
+	for _, tt := range tests {
+		vrc.bypass = tt.bypass
+		buf, err := m.serialise_rx(tt.phase, vrc)
+		if err != nil {
+			t.Fatalf("phase %d: %v", tt.phase, err)
+		}
+		if len(buf) != 2*m.nchan {
+			t.Fatalf("phase %d: %d bytes", tt.phase, len(buf))
+		}
+		if y, th, a := rx_chan(m, buf, 3), rx_chan(m, buf, 2), rx_chan(m, buf, 9); y != tt.yaw || th != tt.thr || a != tt.arm {
+			t.Errorf("phase %d (bypass %v): yaw %d thr %d arm %d, want %d %d %d", tt.phase, tt.bypass,
+				y, th, a, tt.yaw, tt.thr, tt.arm)
+		}
+		if v := rx_chan(m, buf, 4); v != aux_DEFAULT {
+			t.Errorf("phase %d: AUX1 %d", tt.phase, v)
+		}
+	}
+	if vrc.yaw != 50 {
+		t.Errorf("the bypass changed the yaw stick to %d", vrc.yaw)
+	}
+
+	// No arm channel, nothing is written for it
+	m.armchan = -1
+	buf, err := m.serialise_rx(PHASE_Disarming, vrc)
+	if err != nil || rx_chan(m, buf, 0) != 1500 || rx_chan(m, buf, 9) != aux_DEFAULT {
+		t.Errorf("no arm channel: %v %v", m.deserialise_rx(buf), err)
+	}
+
+	// ARM on AUX17 with 18 channels is an error, not a panic
+	m.armchan, m.armval = 20, 1800
+	if _, err := m.serialise_rx(PHASE_Arming, vrc); err == nil {
+		t.Error("arm channel 21 of 18: no error")
+	}
+}
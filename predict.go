@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"strings"
+	"time"
+)
+
+// Mode activation predictor. From the RC channels being sent and the
+// mode ranges, work out which modes the FC should report and compare
+// with its box flags. A persistent difference is logged (once), as it
+// usually means something the simple range model doesn't know about.
+
+type mode_predict struct {
+	diff   uint64 // predicted ^ reported, for ranged modes
+	t      time.Time
+	logged bool
+}
+
+// predict_modes returns the modes with an active range for the RC
+// frame tx (as from serialise_rx)
+func (m *MSPSerial) predict_modes(tx []byte) mode_set {
+	on := make(mode_set)
+	for _, r := range m.mranges {
+		off := (4 + int(r.chanidx)) * 2
+		if off+2 > len(tx) {
+			continue
+		}
+		if r.active(binary.LittleEndian.Uint16(tx[off : off+2])) {
+			on[r.boxid] = true
+		}
+	}
+	return on
+}
+
+func (m *MSPSerial) mask_names(mask uint64) string {
+	return strings.Replace(m.format_box(mask), ",", "+", -1)
+}
+
+// check_modes compares the prediction for tx with the FC box flags
+func (m *MSPSerial) check_modes(tx []byte, boxflags uint64) {
+	if tx == nil || boxflags&m.fail_mask != 0 { // F/S overrides the modes
+		m.pred = mode_predict{}
+		return
+	}
+	var ranged, predicted uint64
+	on := m.predict_modes(tx)
+	for _, r := range m.mranges {
+		if r.boxid == PERM_ARM { // the ARM box is the armed state
+			continue
+		}
+		mask := m.mode_mask(r.boxid)
+		ranged |= mask
+		if on[r.boxid] {
+			predicted |= mask
+		}
+	}
+	diff := predicted ^ (boxflags & ranged)
+	if diff != m.pred.diff {
+		if diff == 0 && m.pred.logged {
+			log.Println("Modes: FC agrees with the mode ranges")
+		}
+		m.pred = mode_predict{diff: diff, t: time.Now()}
+		return
+	}
+	if diff == 0 || m.pred.logged || time.Since(m.pred.t) < mode_VERIFY {
+		return
+	}
+	m.pred.logged = true
+	if missing := diff & predicted; missing != 0 {
+		log.Printf("Modes: expected %s not reported by FC; logic conditions, linked modes, nav requirements (position, armed) or FC not using MSP RX?\n",
+			m.mask_names(missing))
+	}
+	if extra := diff &^ predicted; extra != 0 {
+		log.Printf("Modes: FC reports %s without an active range; wrong channel map, or another RC source?\n",
+			m.mask_names(extra))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// RC delivery check. MSP_RC returns the channels the FC is using, sticks
+// in its internal (AERT) order then the AUX channels; this is compared
+// with what serialise_rx sent, so a wrong RX map, values altered by the
+// FC (rxrange, rx_min_usec / rx_max_usec) or RC that isn't ours (a
+// receiver_type other than MSP, another RC source) is seen. The echo may
+// be for the previous frame, so either frame is accepted. On a slow
+// serial link, the echo is only requested every rc_SLOW_EVERY frames.
+
+type rc_fault int
+
+const (
+	rc_UNKNOWN rc_fault = iota // no echo (yet)
+	rc_OK
+	rc_MAP    // stick channels in the wrong order
+	rc_CLAMP  // values altered by the FC
+	rc_SOURCE // the FC's RC isn't what was sent
+)
+
+var rc_labels = [...]string{"--", "ok", "MAP", "CLAMP", "SRC"}
+
+func (f rc_fault) String() string {
+	return rc_labels[f]
+}
+
+const (
+	rc_TOLERANCE  = 2                       // us
+	rc_CONFIRM    = 1500 * time.Millisecond // a fault must persist for this long
+	rc_SLOW_BAUD  = 19200                   // and below, a slow link
+	rc_SLOW_EVERY = 10                      // frames per echo on a slow link
+)
+
+type rc_health struct {
+	state  rc_fault // as reported
+	cand   rc_fault // latest check
+	detail string
+	t      time.Time // cand since
+}
+
+// rc_every is how many RC frames are sent per MSP_RC echo request
+func (m *MSPSerial) rc_every() int {
+	baud := 0
+	switch m.dd.klass {
+	case DevClass_SERIAL, DevClass_USB:
+		baud = m.dd.param
+	case DevClass_RFC2217:
+		baud = m.dd.param1
+	}
+	if baud > 0 && baud <= rc_SLOW_BAUD {
+		return rc_SLOW_EVERY
+	}
+	return 1
+}
+
+var stick_names = [4]string{"roll", "pitch", "yaw", "throttle"}
+
+// stick_chan is the (0 based) channel carrying stick i (AERT order)
+func (m *MSPSerial) stick_chan(i int) int {
+	return int([4]int8{m.a, m.e, m.r, m.t}[i] / 2)
+}
+
+// rc_expect is the MSP_RC reply expected for the RC frame tx
+func (m *MSPSerial) rc_expect(tx []byte) []int16 {
+	raw := m.deserialise_rx(tx)
+	exp := append([]int16{}, raw...)
+	for i := 0; i < 4; i++ {
+		if c := m.stick_chan(i); c < len(raw) {
+			exp[i] = raw[c]
+		}
+	}
+	return exp
+}
+
+func rc_near(a, b int16) bool {
+	d := int(a) - int(b)
+	return d >= -rc_TOLERANCE && d <= rc_TOLERANCE
+}
+
+// rc_classify compares the MSP_RC reply echo with the last two frames sent
+func (m *MSPSerial) rc_classify(tx, prev, echo []byte) (rc_fault, string) {
+	got := m.deserialise_rx(echo)
+	exp := m.rc_expect(tx)
+	pexp := exp
+	if prev != nil {
+		pexp = m.rc_expect(prev)
+	}
+	n := len(got)
+	if len(exp) < n {
+		n = len(exp)
+	}
+	var bad []int
+	for i := 0; i < n; i++ {
+		if !rc_near(got[i], exp[i]) && (i >= len(pexp) || !rc_near(got[i], pexp[i])) {
+			bad = append(bad, i)
+		}
+	}
+	switch {
+	case len(bad) == 0:
+		return rc_OK, ""
+	case 2*len(bad) > n:
+		return rc_SOURCE, fmt.Sprintf("%d of %d channels are not as sent; receiver_type not MSP, or another RC source?",
+			len(bad), n)
+	}
+
+	// A stick with another stick's value is a map problem
+	raw := m.deserialise_rx(tx)
+	for _, i := range bad {
+		if i >= 4 {
+			continue
+		}
+		for j := 0; j < 4; j++ {
+			if rc_near(got[i], raw[j]) {
+				return rc_MAP, fmt.Sprintf("FC %s has channel %d (%d), expected channel %d for map %s; wrong RX map?",
+					stick_names[i], j+1, got[i], m.stick_chan(i)+1, m.Info.RxMap)
+			}
+		}
+	}
+	i := bad[0]
+	ch := i + 1
+	if i < 4 {
+		ch = m.stick_chan(i) + 1
+	}
+	return rc_CLAMP, fmt.Sprintf("channel %d sent %d, FC has %d; rxrange, rx_min_usec / rx_max_usec?",
+		ch, exp[i], got[i])
+}
+
+// check_rc updates the RC health from an MSP_RC reply, logging changes
+func (m *MSPSerial) check_rc(tx, prev, echo []byte) {
+	if tx == nil {
+		return
+	}
+	f, detail := m.rc_classify(tx, prev, echo)
+	if f != m.rch.cand {
+		m.rch.cand, m.rch.t = f, time.Now()
+	}
+	m.rch.detail = detail
+	if f == m.rch.state || (f != rc_OK && time.Since(m.rch.t) < rc_CONFIRM) {
+		return
+	}
+	if f == rc_OK {
+		if m.rch.state != rc_UNKNOWN {
+			log.Println("RC: FC has the RC sent")
+		}
+	} else {
+		log.Printf("RC: %s\n", detail)
+	}
+	m.rch.state = f
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestRCEvery(t *testing.T) {
+	for dev, want := range map[string]int{"/dev/ttyUSB0@9600": 10, "/dev/ttyUSB0@19200": 10,
+		"/dev/ttyUSB0@115200": 1, "usb:@9600": 10, "rfc2217://host:2217?baud=9600": 10,
+		"tcp://localhost:5761": 1, "mock://": 1} {
+		m := &MSPSerial{dd: parse_device(dev)}
+		if got := m.rc_every(); got != want {
+			t.Errorf("%s: %d, want %d", dev, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+const reconnect_RETRY = time.Second
+
+type resume_result struct {
+	sess *fc_session
+	err  error
+}
+
+// fc_session is the FC state read on reconnection. It is only read by
+// the reconnecting goroutine; resume applies it, from the main loop, so
+// the session state (boxes, mode ranges, channels, RX map) has a single
+// owner.
+type fc_session struct {
+	api      []byte
+	rxmap    []byte
+	rc       []byte
+	boxnames string
+	boxids   []byte
+	ranges   []byte
+	boxflags uint64
+	armflags uint32
+}
+
+// Reconnect reopens the original device after the transport has failed,
+// retrying until giveup has elapsed. Once the FC answers again, the
+// essential parts of MSPInit are repeated and the FC's arming state is
+// read, for resume.
+func (m *MSPSerial) Reconnect(giveup time.Duration, stscmd uint16) (*fc_session, error) {
+	deadline := time.Now().Add(giveup)
+	for n := 1; time.Now().Before(deadline); n++ {
+		sd, err := m.reopen(deadline)
+		if err == nil {
+			m.wmu.Lock()
+			m.attach(sd)
+			m.wmu.Unlock()
+			m.mu.Lock()
+			m.closed = false
+			m.mu.Unlock()
+			m.start_reader()
+			s, err := m.read_session(stscmd)
+			if err == nil {
+				return s, nil
+			}
+			log.Printf("Reconnect: FC not responding (%v)\n", err)
+			sd.Close()
+			// its transport failure must not close the next attempt
+			<-m.rdone
+		} else if n == 1 {
+			log.Printf("Reconnect: %v\n", err)
+		}
+		time.Sleep(reconnect_RETRY)
+	}
+	return nil, fmt.Errorf("gave up reconnecting after %v", giveup)
+}
+
+// reopen opens the device again; a TCP connection attempt, or for
+// tcp-listen the wait for a peer, ends at the give-up deadline
+func (m *MSPSerial) reopen(deadline time.Time) (SerDev, error) {
+	dd := m.dd
+	if rem := time.Until(deadline); dd.timeout == 0 || dd.timeout > rem {
+		dd.timeout = rem
+	}
+	sd, err := open_device(&dd)
+	m.dd.param = dd.param // as found by autobaud
+	return sd, err
+}
+
+// read_session re-reads the API version, RX map, channel count, boxes,
+// mode ranges and status
+func (m *MSPSerial) read_session(stscmd uint16) (*fc_session, error) {
+	s := &fc_session{}
+	v, err := m.Transact(msp.API_VERSION, nil, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s.api = v.data[:v.len]
+	if v, err = m.Transact(msp.RX_MAP, nil, time.Second); err == nil && v.len == 4 {
+		s.rxmap = v.data[:v.len]
+	}
+	if v, err = m.Transact(msp.RC, nil, time.Second); err == nil {
+		s.rc = v.data[:v.len]
+	}
+	if v, err = m.Transact(msp.BOXNAMES, nil, time.Second); err == nil && v.len > 0 {
+		s.boxnames = string(v.data[:v.len])
+		if v, err = m.Transact(msp.BOXIDS, nil, time.Second); err == nil {
+			s.boxids = v.data[:v.len]
+		}
+	}
+	if v, err = m.Transact(msp.MODE_RANGES, nil, time.Second); err == nil && v.len > 0 {
+		s.ranges = v.data[:v.len]
+	}
+	if v, err = m.Transact(stscmd, nil, time.Second); err != nil {
+		return nil, err
+	}
+	s.boxflags, s.armflags = get_status(v)
+	return s, nil
+}
+
+// resume applies a session read on reconnection (the FC may have been
+// reflashed or reconfigured meanwhile): the arm and angle channels are
+// found again and the mode selection re-solved. It returns the phase
+// matching the FC's arming state: LowThrottle if still armed, else
+// Quiescent.
+func (m *MSPSerial) resume(s *fc_session) int {
+	if len(s.api) > 2 {
+		m.set_api(s.api)
+	}
+	if s.rxmap != nil {
+		m.Info.RxMap = m.set_rxmap(s.rxmap)
+	}
+	if s.rc != nil {
+		m.set_nchan(s.rc)
+	}
+	if s.boxnames != "" {
+		m.set_boxes(s.boxnames, s.boxids)
+		m.Info.Boxes = m.boxes.Names()
+	}
+	if s.ranges != nil {
+		m.mranges = nil
+		m.armchan, m.armval, m.angchan = -1, 0, -1
+		m.deserialise_modes(s.ranges)
+		m.set_info_ranges()
+	}
+	if !m.arm_usable() {
+		log.Println("Resumed: no usable ARM range, arming unavailable")
+	}
+	if err := m.set_modes(m.cmodes); err != nil {
+		log.Printf("Resumed: mode %s no longer available (%v)\n", m.mode_label(), err)
+		m.cmodes = nil
+		m.amu.Lock()
+		m.auxvals = nil
+		m.amu.Unlock()
+	}
+	log.Printf("Resumed: Box: %s (%x) Arm: %s\n", m.format_box(s.boxflags), s.boxflags, arm_status(s.armflags))
+	if s.boxflags&m.arm_mask != 0 {
+		return PHASE_LowThrottle
+	}
+	return PHASE_Quiescent
+}
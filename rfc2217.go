@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RFC 2217 (Telnet COM Port Control) client, e.g. for ser2net
+
+const (
+	tn_SE   = 240
+	tn_SB   = 250
+	tn_WILL = 251
+	tn_WONT = 252
+	tn_DO   = 253
+	tn_DONT = 254
+	tn_IAC  = 255
+
+	tnopt_BINARY   = 0
+	tnopt_ECHO     = 1
+	tnopt_SGA      = 3
+	tnopt_COM_PORT = 44
+
+	cpc_SET_BAUDRATE = 1
+	cpc_SET_DATASIZE = 2
+	cpc_SET_PARITY   = 3
+	cpc_SET_STOPSIZE = 4
+	cpc_SERVER_BASE  = 100 // server replies are the client command + 100
+
+	cpc_PARITY_NONE = 1
+	cpc_STOPSIZE_1  = 1
+)
+
+const (
+	tnstate_DATA = iota
+	tnstate_IAC
+	tnstate_OPT
+	tnstate_SB
+	tnstate_SB_IAC
+)
+
+type RFC2217 struct {
+	conn   net.Conn
+	wmu    sync.Mutex
+	raw    []byte
+	state  int
+	verb   byte
+	sb     []byte
+	local  map[byte]bool // options we have agreed to perform (WILL)
+	remote map[byte]bool // options the server has agreed to perform (DO)
+	rerr   error         // read error, returned after the data read with it
+}
+
+// NewRFC2217 connects to host:port, negotiates binary mode and the COM
+// port option and sets the line to baud 8N1 (baud 0 leaves the server's
+// setting unchanged). A non-zero timeout bounds the connection attempt.
+func NewRFC2217(host string, port int, baud int, timeout time.Duration) (*RFC2217, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &RFC2217{conn: conn, raw: make([]byte, 1024),
+		local: make(map[byte]bool), remote: make(map[byte]bool)}
+
+	var neg []byte
+	for _, o := range []byte{tnopt_BINARY, tnopt_SGA, tnopt_COM_PORT} {
+		neg = append(neg, tn_IAC, tn_WILL, o)
+		r.local[o] = true
+	}
+	for _, o := range []byte{tnopt_BINARY, tnopt_SGA} {
+		neg = append(neg, tn_IAC, tn_DO, o)
+		r.remote[o] = true
+	}
+	if baud != 0 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(baud))
+		neg = append(neg, subneg(cpc_SET_BAUDRATE, b)...)
+	}
+	neg = append(neg, subneg(cpc_SET_DATASIZE, []byte{8})...)
+	neg = append(neg, subneg(cpc_SET_PARITY, []byte{cpc_PARITY_NONE})...)
+	neg = append(neg, subneg(cpc_SET_STOPSIZE, []byte{cpc_STOPSIZE_1})...)
+	if err := r.write_raw(neg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// subneg builds IAC SB COM-PORT-OPTION cmd value IAC SE
+func subneg(cmd byte, val []byte) []byte {
+	b := []byte{tn_IAC, tn_SB, tnopt_COM_PORT, cmd}
+	b = append(b, iac_escape(val)...)
+	return append(b, tn_IAC, tn_SE)
+}
+
+func iac_escape(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+	for _, c := range buf {
+		if c == tn_IAC {
+			out = append(out, tn_IAC)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (r *RFC2217) write_raw(buf []byte) error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	_, err := r.conn.Write(buf)
+	return err
+}
+
+// Read returns serial data, with Telnet commands removed and answered
+func (r *RFC2217) Read(buf []byte) (int, error) {
+	for {
+		max := len(buf)
+		if max > len(r.raw) {
+			max = len(r.raw)
+		}
+		if err := r.rerr; err != nil {
+			r.rerr = nil
+			return 0, err
+		}
+		nr, err := r.conn.Read(r.raw[:max])
+		if nr == 0 {
+			return 0, err
+		}
+		r.rerr = err
+		n := 0
+		for _, c := range r.raw[:nr] {
+			if r.filter(c) {
+				buf[n] = c
+				n++
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// filter runs the Telnet state machine, returning true for data bytes
+func (r *RFC2217) filter(c byte) bool {
+	switch r.state {
+	case tnstate_DATA:
+		if c == tn_IAC {
+			r.state = tnstate_IAC
+			return false
+		}
+		return true
+	case tnstate_IAC:
+		switch c {
+		case tn_IAC:
+			r.state = tnstate_DATA
+			return true
+		case tn_WILL, tn_WONT, tn_DO, tn_DONT:
+			r.verb = c
+			r.state = tnstate_OPT
+		case tn_SB:
+			r.sb = r.sb[:0]
+			r.state = tnstate_SB
+		default: // NOP, GA etc.
+			r.state = tnstate_DATA
+		}
+	case tnstate_OPT:
+		r.negotiate(r.verb, c)
+		r.state = tnstate_DATA
+	case tnstate_SB:
+		if c == tn_IAC {
+			r.state = tnstate_SB_IAC
+		} else {
+			r.sb = append(r.sb, c)
+		}
+	case tnstate_SB_IAC:
+		switch c {
+		case tn_IAC:
+			r.sb = append(r.sb, c)
+			r.state = tnstate_SB
+		case tn_SE:
+			r.subnegotiation(r.sb)
+			r.state = tnstate_DATA
+		default:
+			r.state = tnstate_DATA
+		}
+	}
+	return false
+}
+
+// negotiate answers an option request, replying only on a change of
+// state so as not to loop
+func (r *RFC2217) negotiate(verb byte, opt byte) {
+	supported := opt == tnopt_BINARY || opt == tnopt_SGA || opt == tnopt_COM_PORT
+	var reply byte
+	switch verb {
+	case tn_DO:
+		if supported {
+			if r.local[opt] {
+				return
+			}
+			r.local[opt] = true
+			reply = tn_WILL
+		} else {
+			reply = tn_WONT
+		}
+	case tn_DONT:
+		if !r.local[opt] {
+			return
+		}
+		r.local[opt] = false
+		reply = tn_WONT
+	case tn_WILL:
+		if supported {
+			if r.remote[opt] {
+				return
+			}
+			r.remote[opt] = true
+			reply = tn_DO
+		} else {
+			reply = tn_DONT
+		}
+	case tn_WONT:
+		if !r.remote[opt] {
+			return
+		}
+		r.remote[opt] = false
+		reply = tn_DONT
+	}
+	r.write_raw([]byte{tn_IAC, reply, opt})
+}
+
+func (r *RFC2217) subnegotiation(sb []byte) {
+	if len(sb) >= 6 && sb[0] == tnopt_COM_PORT && sb[1] == cpc_SET_BAUDRATE+cpc_SERVER_BASE {
+		log.Printf("RFC2217: server set %d baud\n", binary.BigEndian.Uint32(sb[2:6]))
+	}
+}
+
+// Write sends serial data, escaping IAC
+func (r *RFC2217) Write(buf []byte) (int, error) {
+	if err := r.write_raw(iac_escape(buf)); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (r *RFC2217) Close() error {
+	return r.conn.Close()
+}
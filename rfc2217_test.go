@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rfc2217_pair connects an RFC2217 client to a fake server
+func rfc2217_pair(t *testing.T, baud int) (*RFC2217, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		conns <- c
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	r, err := NewRFC2217(host, p, baud, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-conns
+	t.Cleanup(func() {
+		r.Close()
+		srv.Close()
+	})
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return r, srv
+}
+
+// expect reads len(want) bytes from the server side
+func expect(t *testing.T, srv net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(srv, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("server got % x (%v), want % x", got, err, want)
+	}
+}
+
+func TestRFC2217Negotiation(t *testing.T) {
+	_, srv := rfc2217_pair(t, 115200)
+	want := []byte{
+		tn_IAC, tn_WILL, tnopt_BINARY, tn_IAC, tn_WILL, tnopt_SGA, tn_IAC, tn_WILL, tnopt_COM_PORT,
+		tn_IAC, tn_DO, tnopt_BINARY, tn_IAC, tn_DO, tnopt_SGA,
+	}
+	want = append(want, subneg(cpc_SET_BAUDRATE, []byte{0, 1, 0xc2, 0})...)
+	want = append(want, subneg(cpc_SET_DATASIZE, []byte{8})...)
+	want = append(want, subneg(cpc_SET_PARITY, []byte{cpc_PARITY_NONE})...)
+	want = append(want, subneg(cpc_SET_STOPSIZE, []byte{cpc_STOPSIZE_1})...)
+	expect(t, srv, want)
+}
+
+func TestRFC2217Data(t *testing.T) {
+	r, srv := rfc2217_pair(t, 0)
+	if _, err := io.ReadFull(srv, make([]byte, 15+3*7)); err != nil { // the negotiation, less the baud rate
+		t.Fatal(err)
+	}
+
+	// IAC in the data is doubled
+	r.Write([]byte{'$', tn_IAC, 'M'})
+	expect(t, srv, []byte{'$', tn_IAC, tn_IAC, 'M'})
+
+	// Commands are removed from the data and answered
+	srv.Write([]byte{'a', tn_IAC, tn_IAC, tn_IAC, tn_WILL, 99, 'b',
+		tn_IAC, tn_SB, tnopt_COM_PORT, cpc_SET_BAUDRATE + cpc_SERVER_BASE, 0, 0, 0x25, 0x80, tn_IAC, tn_SE,
+		tn_IAC, tn_DO, tnopt_BINARY, 'c'})
+	var got []byte
+	buf := make([]byte, 16)
+	for len(got) < 4 {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, []byte{'a', tn_IAC, 'b', 'c'}) {
+		t.Errorf("read % x", got)
+	}
+	// unsupported option refused, BINARY already agreed so not answered
+	expect(t, srv, []byte{tn_IAC, tn_DONT, 99})
+
+	// the server doesn't echo our data
+	srv.Write([]byte{tn_IAC, tn_WILL, tnopt_ECHO, 'd'})
+	if n, err := r.Read(buf); err != nil || n != 1 || buf[0] != 'd' {
+		t.Fatalf("read % x %v", buf[:n], err)
+	}
+	expect(t, srv, []byte{tn_IAC, tn_DONT, tnopt_ECHO})
+}
+
+// eof_conn returns its data with io.EOF
+type eof_conn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *eof_conn) Read(buf []byte) (int, error) {
+	n := copy(buf, c.data)
+	c.data = c.data[n:]
+	return n, io.EOF
+}
+
+func TestRFC2217ReadError(t *testing.T) {
+	r := &RFC2217{conn: &eof_conn{data: []byte("$M>")}, raw: make([]byte, 1024),
+		local: make(map[byte]bool), remote: make(map[byte]bool)}
+	buf := make([]byte, 16)
+	if n, err := r.Read(buf); n != 3 || err != nil || string(buf[:n]) != "$M>" {
+		t.Errorf("first read: \"%s\" %v", buf[:n], err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("second read: %d %v", n, err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TByte007/msp_control/msp"
+)
+
+// FC settings (as the CLI get / set) via the MSPv2 common setting
+// commands. MSP2_COMMON_SETTING_INFO describes a setting (by name or
+// index): type, range, lookup table and current value.
+
+const setting_TIMEOUT = time.Second
+
+// Setting types
+const (
+	setting_UINT8 = iota
+	setting_INT8
+	setting_UINT16
+	setting_INT16
+	setting_UINT32
+	setting_FLOAT
+	setting_STRING
+)
+
+const setting_MODE_LOOKUP = 0x40
+
+var setting_types = []string{"uint8", "int8", "uint16", "int16", "uint32", "float", "string"}
+
+type Setting struct {
+	Name     string      `json:"name"`
+	PGN      uint16      `json:"pgn"`
+	Type     string      `json:"type"`
+	Min      int32       `json:"min"`
+	Max      uint32      `json:"max"`
+	Index    uint16      `json:"index"`
+	Profile  uint8       `json:"profile,omitempty"`
+	Profiles uint8       `json:"profiles,omitempty"`
+	Table    []string    `json:"values,omitempty"`
+	Value    interface{} `json:"value"`
+	typ      byte
+}
+
+// Value names for nav_extra_arming_safety; INAV 6 dropped "OFF"
+var arming_safety_names = []string{"OFF", "ON", "ALLOW_BYPASS"}
+
+// arming_safety_name names a normalised nav_extra_arming_safety value,
+// or gives the number for one this doesn't know
+func arming_safety_name(n int) string {
+	if n >= 0 && n < len(arming_safety_names) {
+		return arming_safety_names[n]
+	}
+	return strconv.Itoa(n)
+}
+
+func setting_id(name string) []byte {
+	return append([]byte(name), 0)
+}
+
+func setting_index(idx uint16) []byte {
+	return []byte{0, byte(idx), byte(idx >> 8)}
+}
+
+// decode_setting_info parses an MSP2_COMMON_SETTING_INFO reply
+func decode_setting_info(data []byte) (*Setting, error) {
+	n := bytes.IndexByte(data, 0)
+	if n < 0 || len(data) < n+18 {
+		return nil, errors.New("short setting info")
+	}
+	s := &Setting{Name: string(data[:n])}
+	b := data[n+1:]
+	s.PGN = binary.LittleEndian.Uint16(b[0:2])
+	s.typ = b[2] & 0x7
+	mode := b[4]
+	s.Min = int32(binary.LittleEndian.Uint32(b[5:9]))
+	s.Max = binary.LittleEndian.Uint32(b[9:13])
+	s.Index = binary.LittleEndian.Uint16(b[13:15])
+	s.Profile = b[15]
+	s.Profiles = b[16]
+	if int(s.typ) >= len(setting_types) {
+		return nil, fmt.Errorf("%s: unknown type %d", s.Name, s.typ)
+	}
+	s.Type = setting_types[s.typ]
+	b = b[17:]
+	if mode == setting_MODE_LOOKUP {
+		for i := int64(s.Min); i <= int64(s.Max); i++ {
+			n := bytes.IndexByte(b, 0)
+			if n < 0 {
+				return nil, fmt.Errorf("%s: short lookup table", s.Name)
+			}
+			s.Table = append(s.Table, string(b[:n]))
+			b = b[n+1:]
+		}
+	}
+	s.Value = s.decode(b)
+	return s, nil
+}
+
+func (s *Setting) decode(b []byte) interface{} {
+	var v int64
+	switch {
+	case s.typ == setting_STRING:
+		return strings.TrimRight(string(b), "\x00")
+	case s.typ == setting_FLOAT && len(b) >= 4:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case (s.typ == setting_UINT8 || s.typ == setting_INT8) && len(b) >= 1:
+		v = int64(b[0])
+		if s.typ == setting_INT8 {
+			v = int64(int8(b[0]))
+		}
+	case (s.typ == setting_UINT16 || s.typ == setting_INT16) && len(b) >= 2:
+		v = int64(binary.LittleEndian.Uint16(b))
+		if s.typ == setting_INT16 {
+			v = int64(int16(v))
+		}
+	case s.typ == setting_UINT32 && len(b) >= 4:
+		v = int64(binary.LittleEndian.Uint32(b))
+	default:
+		return nil
+	}
+	if s.Table != nil {
+		if i := v - int64(s.Min); i >= 0 && i < int64(len(s.Table)) {
+			return s.Table[i]
+		}
+	}
+	return v
+}
+
+// encode converts a value string (number, or name for a lookup setting)
+// to the FC representation, checking the range
+func (s *Setting) encode(str string) ([]byte, error) {
+	if s.typ == setting_STRING {
+		if uint32(len(str)) > s.Max {
+			return nil, fmt.Errorf("%s: string longer than %d", s.Name, s.Max)
+		}
+		return []byte(str), nil
+	}
+	if s.typ == setting_FLOAT {
+		f, err := strconv.ParseFloat(str, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid value \"%s\"", s.Name, str)
+		}
+		if f < float64(s.Min) || f > float64(s.Max) {
+			return nil, fmt.Errorf("%s: %s out of range %d .. %d", s.Name, str, s.Min, s.Max)
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f)))
+		return b, nil
+	}
+
+	var v int64
+	found := false
+	for i, name := range s.Table {
+		if strings.EqualFold(name, str) {
+			v = int64(s.Min) + int64(i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		var err error
+		if v, err = strconv.ParseInt(str, 0, 64); err != nil {
+			if s.Table != nil {
+				return nil, fmt.Errorf("%s: invalid value \"%s\" (%s)", s.Name, str, strings.Join(s.Table, ", "))
+			}
+			return nil, fmt.Errorf("%s: invalid value \"%s\"", s.Name, str)
+		}
+	}
+	if v < int64(s.Min) || v > int64(s.Max) {
+		return nil, fmt.Errorf("%s: %s out of range %d .. %d", s.Name, str, s.Min, s.Max)
+	}
+	switch s.typ {
+	case setting_UINT8, setting_INT8:
+		return []byte{byte(v)}, nil
+	case setting_UINT16, setting_INT16:
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, uint16(v))
+		return b, nil
+	default:
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(v))
+		return b, nil
+	}
+}
+
+func (s *Setting) String() string {
+	str := fmt.Sprintf("%s = %v", s.Name, s.Value)
+	switch {
+	case s.Table != nil:
+		str += fmt.Sprintf(" (%s)", strings.Join(s.Table, ", "))
+	case s.typ == setting_STRING:
+		str += fmt.Sprintf(" (string, max %d)", s.Max)
+	default:
+		str += fmt.Sprintf(" (%s, %d .. %d)", s.Type, s.Min, s.Max)
+	}
+	return str
+}
+
+// setting_info runs MSP2_COMMON_SETTING_INFO for a setting id (name or index)
+func (m *MSPSerial) setting_info(id []byte) (*Setting, error) {
+	v, err := m.Transact(msp.COMMON_SETTING_INFO, id, setting_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return decode_setting_info(v.data[:v.len])
+}
+
+// GetSetting describes a setting and reads its value (the setting info
+// carries it)
+func (m *MSPSerial) GetSetting(name string) (*Setting, error) {
+	s, err := m.setting_info(setting_id(name))
+	if err != nil {
+		var merr *MSPError
+		if errors.As(err, &merr) {
+			return nil, fmt.Errorf("%s: no such setting", name)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSetting writes a setting (not saved until SaveEEPROM) and reads it back
+func (m *MSPSerial) SetSetting(name string, value string) (*Setting, error) {
+	s, err := m.GetSetting(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.encode(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = m.Transact(msp.COMMON_SET_SETTING, append(setting_id(name), b...), setting_TIMEOUT); err != nil {
+		return nil, err
+	}
+	return m.GetSetting(name)
+}
+
+// ListSettings describes every setting, in index order
+func (m *MSPSerial) ListSettings() ([]*Setting, error) {
+	var list []*Setting
+	for idx := uint16(0); ; idx++ {
+		s, err := m.setting_info(setting_index(idx))
+		if err != nil {
+			var merr *MSPError
+			if errors.As(err, &merr) {
+				break // past the last setting
+			}
+			return list, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+func (m *MSPSerial) SaveEEPROM() error {
+	_, err := m.Transact(msp.EEPROM_WRITE, nil, 2*setting_TIMEOUT)
+	return err
+}
+
+// probe_settings finds the settings commands, where arming_safety
+// didn't (e.g. an FC without that setting)
+func (m *MSPSerial) probe_settings() {
+	if !m.caps.Has(CAP_SETTING_INFO) {
+		if _, ok := m.probe(msp.COMMON_SETTING_INFO, setting_index(0)); ok {
+			m.caps |= CAP_SETTING_INFO
+		}
+	}
+	if !m.caps.Has(CAP_COMMON_SETTING) {
+		if _, ok := m.probe(msp.COMMON_SETTING, setting_index(0)); ok {
+			m.caps |= CAP_COMMON_SETTING
+		}
+	}
+}
+
+// arming_safety reads nav_extra_arming_safety, returning the FC's value
+// and that normalised to the pre INAV 6 values (0 OFF, 1 ON, 2
+// ALLOW_BYPASS), both -1 if unavailable. Without setting info, the value
+// is normalised by firmware version.
+func (m *MSPSerial) arming_safety(v6 bool) (int, int) {
+	if s, err := m.GetSetting(SETTING_STR); err == nil {
+		m.caps |= CAP_SETTING_INFO
+		if name, ok := s.Value.(string); ok {
+			raw := -1
+			for i, n := range s.Table {
+				if n == name {
+					raw = i + int(s.Min)
+				}
+			}
+			for i, n := range arming_safety_names {
+				if n == name {
+					return raw, i
+				}
+			}
+		}
+		return -1, -1
+	} else if errors.Is(err, ErrTransport) {
+		log.Fatalln("MSPInit: link lost")
+	}
+	if v, ok := m.probe(msp.COMMON_SETTING, setting_id(SETTING_STR)); ok && v.len > 0 {
+		m.caps |= CAP_COMMON_SETTING
+		raw := int(v.data[0])
+		if v6 {
+			return raw, raw + 1
+		}
+		return raw, raw
+	}
+	return -1, -1
+}
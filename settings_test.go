@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestArmingSafetyName(t *testing.T) {
+	for n, want := range map[int]string{0: "OFF", 1: "ON", 2: "ALLOW_BYPASS", 3: "3", -2: "-2"} {
+		if got := arming_safety_name(n); got != want {
+			t.Errorf("%d: got %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestGetSetting(t *testing.T) {
+	m := mock_init(t, "inav7")
+	s, err := m.GetSetting("small_angle")
+	if err != nil || s.Value != int64(25) {
+		t.Fatalf("small_angle: %v %v", s, err)
+	}
+	if s, err = m.SetSetting(SETTING_STR, "on"); err != nil || s.Value != "ON" {
+		t.Errorf("set %s: %v %v", SETTING_STR, s, err)
+	}
+	if _, err = m.GetSetting("no_such_setting"); err == nil {
+		t.Error("no_such_setting: no error")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPListen is a SerDev for FCs / bridges that connect to us. It listens,
+// accepts the first peer and thereafter replaces the peer with any new
+// connection (e.g. an ESP32 bridge that has rebooted and reconnected
+// before the old connection timed out).
+type TCPListen struct {
+	ln   *net.TCPListener
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewTCPListen listens on addr and waits up to timeout (0 for ever) for
+// the first peer
+func NewTCPListen(addr string, timeout time.Duration) (*TCPListen, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Waiting for connection on %s\n", ln.Addr())
+	if timeout > 0 {
+		ln.SetDeadline(time.Now().Add(timeout))
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("accept on %s: %v", addr, err)
+	}
+	ln.SetDeadline(time.Time{})
+	log.Printf("Accepted connection from %s\n", conn.RemoteAddr())
+	t := &TCPListen{ln: ln, conn: conn}
+	go t.accepter()
+	return t, nil
+}
+
+func (t *TCPListen) accepter() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		log.Printf("Replacing connection with %s\n", conn.RemoteAddr())
+		t.mu.Lock()
+		old := t.conn
+		t.conn = conn
+		t.mu.Unlock()
+		old.Close()
+	}
+}
+
+func (t *TCPListen) current() net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+}
+
+func (t *TCPListen) Read(buf []byte) (int, error) {
+	for {
+		c := t.current()
+		n, err := c.Read(buf)
+		if err != nil && c != t.current() {
+			continue // replaced while reading
+		}
+		return n, err
+	}
+}
+
+func (t *TCPListen) Write(buf []byte) (int, error) {
+	return t.current().Write(buf)
+}
+
+func (t *TCPListen) Close() error {
+	t.ln.Close()
+	return t.current().Close()
+}
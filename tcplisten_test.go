@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// free_addr returns a loopback address with a port that was free
+func free_addr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dial connects to addr once it is listening, nil if it never is
+func dial(addr string) net.Conn {
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestTCPListen(t *testing.T) {
+	addr := free_addr(t)
+	peers := make(chan net.Conn, 1)
+	go func() { peers <- dial(addr) }()
+	tl, err := NewTCPListen(addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	peer := <-peers
+	if peer == nil {
+		t.Fatalf("no listener on %s", addr)
+	}
+	defer peer.Close()
+
+	buf := make([]byte, 16)
+	peer.Write([]byte("fc"))
+	if n, err := tl.Read(buf); err != nil || string(buf[:n]) != "fc" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	tl.Write([]byte("us"))
+	if n, err := peer.Read(buf); err != nil || string(buf[:n]) != "us" {
+		t.Fatalf("peer read %q %v", buf[:n], err)
+	}
+
+	// A new peer replaces the old, even with a read pending
+	got := make(chan string, 1)
+	go func() {
+		n, _ := tl.Read(buf)
+		got <- string(buf[:n])
+	}()
+	peer2 := dial(addr)
+	if peer2 == nil {
+		t.Fatalf("no listener on %s", addr)
+	}
+	defer peer2.Close()
+	peer.Read(make([]byte, 1)) // closed when replaced
+	peer2.Write([]byte("again"))
+	select {
+	case s := <-got:
+		if s != "again" {
+			t.Errorf("after replacement read %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no read from the new peer")
+	}
+}
+
+func TestTCPListenTimeout(t *testing.T) {
+	start := time.Now()
+	if _, err := NewTCPListen(free_addr(t), 100*time.Millisecond); err == nil {
+		t.Fatal("no peer, no error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timed out after %v", d)
+	}
+}
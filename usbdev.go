@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// USB IDs of FC virtual COM ports and common USB-UART adapters
+var known_usb = []struct {
+	vid  string
+	pid  string
+	desc string
+}{
+	{vid: "0483", pid: "5740", desc: "STM32 VCP"},
+	{vid: "2e3c", pid: "5740", desc: "AT32 VCP"},
+	{vid: "10c4", pid: "ea60", desc: "CP210x"},
+	{vid: "0403", pid: "6001", desc: "FTDI"},
+	{vid: "0403", pid: "6010", desc: "FTDI"},
+	{vid: "0403", pid: "6014", desc: "FTDI"},
+	{vid: "0403", pid: "6015", desc: "FTDI"},
+	{vid: "1a86", pid: "7523", desc: "CH340"},
+	{vid: "1a86", pid: "55d4", desc: "CH9102"},
+	{vid: "067b", pid: "2303", desc: "PL2303"},
+}
+
+func usb_known(p *enumerator.PortDetails) string {
+	for _, k := range known_usb {
+		if strings.EqualFold(p.VID, k.vid) && strings.EqualFold(p.PID, k.pid) {
+			return k.desc
+		}
+	}
+	return ""
+}
+
+func usb_ports() ([]*enumerator.PortDetails, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+	return ports, nil
+}
+
+// parse_usbsel parses a selector such as "vid=0483,pid=5740" or
+// "serial=XYZ" (',' or '&' separated; keys vid, pid, serial, product)
+func parse_usbsel(sel string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range strings.FieldsFunc(sel, func(r rune) bool { return r == ',' || r == '&' }) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid USB selector \"%s\"", kv)
+		}
+		k := strings.ToLower(parts[0])
+		switch k {
+		case "vid", "pid", "serial", "product":
+			m[k] = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown USB selector key \"%s\"", k)
+		}
+	}
+	return m, nil
+}
+
+// An empty selector matches the known FC / USB-UART IDs only
+func usb_match(sel map[string]string, p *enumerator.PortDetails) bool {
+	if !p.IsUSB {
+		return false
+	}
+	if len(sel) == 0 {
+		return usb_known(p) != ""
+	}
+	for k, v := range sel {
+		switch k {
+		case "vid":
+			if !strings.EqualFold(p.VID, v) {
+				return false
+			}
+		case "pid":
+			if !strings.EqualFold(p.PID, v) {
+				return false
+			}
+		case "serial":
+			if p.SerialNumber != v {
+				return false
+			}
+		case "product":
+			if !strings.Contains(strings.ToLower(p.Product), strings.ToLower(v)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// find_usb_port returns the name of the first port matching the selector
+func find_usb_port(selstr string) (string, error) {
+	sel, err := parse_usbsel(selstr)
+	if err != nil {
+		return "", err
+	}
+	ports, err := usb_ports()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, p := range ports {
+		if usb_match(sel, p) {
+			found = append(found, p.Name)
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no USB serial device matches \"usb:%s\"", selstr)
+	}
+	if len(found) > 1 {
+		log.Printf("%d devices match \"usb:%s\" (%s), using %s\n", len(found), selstr, strings.Join(found, ", "), found[0])
+	}
+	return found[0], nil
+}
+
+func list_devices() {
+	ports, err := usb_ports()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ports) == 0 {
+		fmt.Fprintln(os.Stderr, "No serial devices found")
+		return
+	}
+	for _, p := range ports {
+		if p.IsUSB {
+			known := usb_known(p)
+			if known != "" {
+				known = " [" + known + "]"
+			}
+			fmt.Printf("%-16s usb:vid=%s,pid=%s serial=%q product=%q%s\n",
+				p.Name, strings.ToLower(p.VID), strings.ToLower(p.PID), p.SerialNumber, p.Product, known)
+		} else {
+			fmt.Printf("%-16s (not USB)\n", p.Name)
+		}
+	}
+}